@@ -1,5 +1,5 @@
 module github.com/someonegg/msgpump/v2
 
-go 1.20
+go 1.21
 
 require github.com/someonegg/gox v1.0.5
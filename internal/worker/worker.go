@@ -0,0 +1,168 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package worker implements the worker goroutines shared by the parallel
+// handlers of msgpump and msgpeer.
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// Group runs the tasks from the worker goroutines, a worker exits after
+// idle for the idle timeout.
+//
+// Group supports concurrently access.
+type Group struct {
+	idle     time.Duration
+	panicLog func(interface{})
+	taskC    chan task
+	sem      chan struct{} // nil if unbounded
+}
+
+type task struct {
+	ctx context.Context
+	f   func()
+}
+
+// NewGroup allocates and returns a new group, there are maxWorkers workers
+// at most, zero means unbounded. The panicLog is optional, see LogPanic.
+func NewGroup(idle time.Duration, panicLog func(interface{}), maxWorkers int) *Group {
+	g := &Group{
+		idle:     idle,
+		panicLog: panicLog,
+		taskC:    make(chan task),
+	}
+	if maxWorkers > 0 {
+		g.sem = make(chan struct{}, maxWorkers)
+	}
+	return g
+}
+
+// TryRun runs f from an idle worker or a new one, it returns false if all
+// the workers are busy and the maximum is reached. The panic of f is logged
+// with ctx, see LogPanic.
+func (g *Group) TryRun(ctx context.Context, f func()) bool {
+	t := task{ctx, f}
+
+	select {
+	case g.taskC <- t:
+		return true
+	default:
+	}
+
+	if g.sem == nil {
+		go g.work(t)
+		return true
+	}
+
+	select {
+	case g.sem <- struct{}{}:
+		go g.work(t)
+		return true
+	default:
+		return false
+	}
+}
+
+// Run waits for a worker to run f, it returns false if ctx is done first.
+func (g *Group) Run(ctx context.Context, f func()) bool {
+	if g.TryRun(ctx, f) {
+		return true
+	}
+
+	t := task{ctx, f}
+	select {
+	case <-ctx.Done():
+		return false
+	case g.taskC <- t:
+	case g.sem <- struct{}{}:
+		go g.work(t)
+	}
+	return true
+}
+
+func (g *Group) work(t task) {
+	defer func() {
+		if g.sem != nil {
+			<-g.sem
+		}
+	}()
+
+	g.run(t)
+
+	timer := time.NewTimer(g.idle)
+	defer timer.Stop()
+
+	for {
+		select {
+		case t = <-g.taskC:
+			g.run(t)
+
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(g.idle)
+		case <-timer.C:
+			return
+		}
+	}
+}
+
+func (g *Group) run(t task) {
+	defer func() {
+		if v := recover(); v != nil {
+			Recovered(t.ctx, g.panicLog, v)
+		}
+	}()
+
+	t.f()
+}
+
+type loggerKey struct{}
+
+// WithLogger returns a copy of ctx with the logger of the worker panics.
+func WithLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// Recovered logs the panic v recovered from a worker by panicLog, or by
+// LogPanic if panicLog is nil.
+func Recovered(ctx context.Context, panicLog func(interface{}), v interface{}) {
+	if panicLog != nil {
+		panicLog(v)
+		return
+	}
+	LogPanic(ctx, v)
+}
+
+// LogPanic is the default panic log function of the workers, it writes to
+// the logger of ctx if set, see WithLogger, or to the log package.
+func LogPanic(ctx context.Context, v interface{}) {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		LogPanicFunc(l, "worker panic")(v)
+		return
+	}
+
+	const size = 16 << 10
+	buf := make([]byte, size)
+	buf = buf[:runtime.Stack(buf, false)]
+	log.Print("worker panic: ", v, fmt.Sprintf("\n%s", buf))
+}
+
+// LogPanicFunc returns a panic log function which writes the panic with
+// stack to l as an error record with msg.
+func LogPanicFunc(l *slog.Logger, msg string) func(panicV interface{}) {
+	return func(v interface{}) {
+		const size = 16 << 10
+		buf := make([]byte, size)
+		buf = buf[:runtime.Stack(buf, false)]
+		l.Error(msg, "panic", v, "stack", string(buf))
+	}
+}
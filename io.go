@@ -4,6 +4,8 @@
 
 package msgpump
 
+import "time"
+
 type Message []byte // single part
 
 func (m Message) Size() int {
@@ -23,6 +25,8 @@ func (m MPMessage) Size() int {
 type message struct {
 	mS Message // or
 	mM MPMessage
+
+	done chan error // not nil if synchronous
 }
 
 func (m message) Size() int {
@@ -46,3 +50,22 @@ type MessageReadWriter interface {
 type StopNotifier interface {
 	OnStop()
 }
+
+// Flusher is an optional interface of MessageWriter, for writers which
+// buffer the written messages.
+//
+// If the MessageReadWriter implements it, the pump will disable the auto
+// flush, write the queued messages in batch, and flush once per batch.
+type Flusher interface {
+	// SetAutoFlush sets whether to flush after every write, it is enabled
+	// by default.
+	SetAutoFlush(auto bool)
+	Flush() error
+}
+
+// DeadlineSetter is an optional interface of MessageReadWriter, it is used
+// by the pump to implement the read idle timeout and the write timeout.
+type DeadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"io"
 	"net"
+	"time"
 )
 
 var errNetconnMessageLength = errors.New("netconn io: wrong message length")
@@ -39,18 +40,43 @@ var NetconnMessageMaxLength = 16 * 1024 * 1024
 //
 //	Length(4-bytes int, big-endian)Message
 func NetconnMRW(c net.Conn) MessageReadWriter {
-	return netconnMRW{c: getNetbufConn(c)}
+	return &netconnMRW{c: getNetbufConn(c), autoFlush: true}
 }
 
 type netconnMRW struct {
-	c netbufconn
+	c         netbufconn
+	autoFlush bool
 }
 
-func (rw netconnMRW) OnStop() {
+func (rw *netconnMRW) OnStop() {
 	rw.c.Close()
 }
 
-func (rw netconnMRW) ReadMessage() (m Message, Err error) {
+func (rw *netconnMRW) SetAutoFlush(auto bool) {
+	rw.autoFlush = auto
+}
+
+func (rw *netconnMRW) Flush() error {
+	return rw.c.Flush()
+}
+
+func (rw *netconnMRW) LocalAddr() net.Addr {
+	return rw.c.conn.LocalAddr()
+}
+
+func (rw *netconnMRW) RemoteAddr() net.Addr {
+	return rw.c.conn.RemoteAddr()
+}
+
+func (rw *netconnMRW) SetReadDeadline(t time.Time) error {
+	return rw.c.conn.SetReadDeadline(t)
+}
+
+func (rw *netconnMRW) SetWriteDeadline(t time.Time) error {
+	return rw.c.conn.SetWriteDeadline(t)
+}
+
+func (rw *netconnMRW) ReadMessage() (m Message, Err error) {
 	var _l int32
 	err := binary.Read(rw.c, binary.BigEndian, &_l)
 	if err != nil {
@@ -75,7 +101,7 @@ func (rw netconnMRW) ReadMessage() (m Message, Err error) {
 	return
 }
 
-func (rw netconnMRW) WriteMessage(m Message) error {
+func (rw *netconnMRW) WriteMessage(m Message) error {
 	l := m.Size()
 
 	err := binary.Write(rw.c, binary.BigEndian, int32(l))
@@ -88,10 +114,13 @@ func (rw netconnMRW) WriteMessage(m Message) error {
 		return err
 	}
 
+	if !rw.autoFlush {
+		return nil
+	}
 	return rw.c.Flush()
 }
 
-func (rw netconnMRW) WriteMessageMP(m MPMessage) error {
+func (rw *netconnMRW) WriteMessageMP(m MPMessage) error {
 	l := m.Size()
 
 	err := binary.Write(rw.c, binary.BigEndian, int32(l))
@@ -105,5 +134,8 @@ func (rw netconnMRW) WriteMessageMP(m MPMessage) error {
 		return err
 	}
 
+	if !rw.autoFlush {
+		return nil
+	}
 	return rw.c.Flush()
 }
@@ -99,3 +99,30 @@ func TestNetconnWriteMP(test *testing.T) {
 		test.Fatal("netconn io: write wrong format")
 	}
 }
+
+func TestNetconnWriteNoAutoFlush(test *testing.T) {
+	c := &mockNetConn{}
+	rw := NetconnMRW(c)
+	fl := rw.(Flusher)
+	fl.SetAutoFlush(false)
+
+	rw.WriteMessage([]byte("m1"))
+	rw.WriteMessageMP(MPMessage{[]byte("m2"), []byte("m3")})
+	if c.Buffer.Len() != 0 {
+		test.Fatal("netconn io: write without flush")
+	}
+
+	err := fl.Flush()
+	if err != nil {
+		test.Fatal(err)
+	}
+
+	m, _ := rw.ReadMessage()
+	if string(m) != "m1" {
+		test.Fatal("netconn io: flush wrong format")
+	}
+	m, _ = rw.ReadMessage()
+	if string(m) != "m2m3" {
+		test.Fatal("netconn io: flush wrong format")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
 type mockMRW struct {
@@ -83,3 +84,36 @@ func (rw *mockMRW) WriteMessageMP(m MPMessage) error {
 	bufs.WriteTo(&rw.b)
 	return nil
 }
+
+type mockFlushMRW struct {
+	mockMRW
+
+	auto bool
+	fcnt int
+}
+
+func (rw *mockFlushMRW) SetAutoFlush(auto bool) {
+	rw.auto = auto
+}
+
+func (rw *mockFlushMRW) Flush() error {
+	rw.fcnt++
+	return nil
+}
+
+type syncBuffer struct {
+	locker sync.Mutex
+	b      bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.b.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.b.String()
+}
@@ -0,0 +1,127 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Codec marshals and unmarshals the typed messages, see Call and HandleCall.
+//
+// The adapters of protobuf and msgpack are in the subpackages protocodec
+// and msgpackcodec, each of them is a separate module, so their dependencies
+// are only required by the users.
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// JSONCodec is the Codec using encoding/json, it is the default.
+var JSONCodec Codec = jsonCodec{}
+
+type codecKey struct{}
+
+// CodecOf returns the codec of the peer which the ctx passed to Handler
+// belongs to, see WithCodec.
+func CodecOf(ctx context.Context) Codec {
+	if c, ok := ctx.Value(codecKey{}).(Codec); ok {
+		return c
+	}
+	return JSONCodec
+}
+
+// Call marshals req with the codec of p, sends it as a request of method,
+// and unmarshals the response, see Peer.Do.
+func Call[Req, Resp any](ctx context.Context, p *Peer, method string, req Req) (Resp, error) {
+	var resp Resp
+
+	r, err := p.codec.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+
+	b, err := p.Do(WithMethod(ctx, method), r)
+	if err != nil {
+		return resp, err
+	}
+
+	err = p.codec.Unmarshal(b, &resp)
+	return resp, err
+}
+
+// Post marshals n with the codec of p, and posts it as a notify of method,
+// see Peer.Notify.
+func Post[N any](ctx context.Context, p *Peer, method string, n N) error {
+	b, err := p.codec.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return p.Notify(WithMethod(ctx, method), b)
+}
+
+// HandleCall registers the typed request processor for the method, the
+// request and response are marshaled by the codec of the peer, see CodecOf.
+//
+// If f returns a *RemoteError, it will be replied as is, the other errors
+// will be replied with CodeInternalError. The request failed to unmarshal
+// will be replied with CodeInvalidRequest.
+func HandleCall[Req, Resp any](mux *ServeMux, method string,
+	f func(ctx context.Context, req Req) (Resp, error)) {
+
+	mux.Handle(method, func(ctx context.Context, r Request, w ResponseWriter) {
+		codec := CodecOf(ctx)
+
+		var req Req
+		if err := codec.Unmarshal(r, &req); err != nil {
+			w.WriteError(ctx, CodeInvalidRequest, err.Error())
+			return
+		}
+
+		resp, err := f(ctx, req)
+		if err != nil {
+			writeError(ctx, w, err)
+			return
+		}
+
+		b, err := codec.Marshal(resp)
+		if err != nil {
+			w.WriteError(ctx, CodeInternalError, err.Error())
+			return
+		}
+		w(ctx, b)
+	})
+}
+
+// HandlePost registers the typed notify processor for the method, the
+// notify is unmarshaled by the codec of the peer, see CodecOf. The notify
+// failed to unmarshal will be dropped.
+func HandlePost[N any](mux *ServeMux, method string, f func(ctx context.Context, n N)) {
+	mux.HandleNotify(method, func(ctx context.Context, b Notify) {
+		var n N
+		if err := CodecOf(ctx).Unmarshal(b, &n); err != nil {
+			return
+		}
+		f(ctx, n)
+	})
+}
+
+func writeError(ctx context.Context, w ResponseWriter, err error) {
+	if re, ok := err.(*RemoteError); ok {
+		w.WriteError(ctx, re.Code, re.Message)
+		return
+	}
+	w.WriteError(ctx, CodeInternalError, err.Error())
+}
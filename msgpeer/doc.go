@@ -6,6 +6,14 @@
 // It considers the client and server peers, allowing each to send requests to the
 // other concurrently.
 //
+// Besides, a request can be replied by a stream of chunks (see DoStream), and
+// long-lived bidirectional streams can be multiplexed over the same peer (see
+// OpenStream and AcceptStream).
+//
+// The requests and notifies can be dispatched by their method names, see
+// WithMethod and ServeMux. The typed messages can be sent and handled with
+// a pluggable codec, see Call and HandleCall.
+//
 // Here is a quick example, includes client and server.
 //
 // Server
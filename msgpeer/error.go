@@ -0,0 +1,63 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+)
+
+// The error codes used by msgpeer itself, the negative codes are reserved.
+const (
+	CodeStreamRefused  = -1
+	CodeMethodNotFound = -2
+	CodeInvalidRequest = -3
+	CodeInternalError  = -4
+	CodeOverloaded     = -5
+	CodeFlowControl    = -6
+)
+
+// RemoteError is returned by Peer.Do when the remote handler replies an
+// error response, see ResponseWriter.WriteError.
+type RemoteError struct {
+	Code    int
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("msgpeer: remote error %d: %s", e.Code, e.Message)
+}
+
+// WriteError writes an error response, then the remote Peer.Do will return
+// a *RemoteError with code and message.
+func (w ResponseWriter) WriteError(ctx context.Context, code int, message string) error {
+	ctx = context.WithValue(ctx, responseKindKey{}, errorResponse)
+	return w(ctx, encodeError(code, message))
+}
+
+// The format of the error body is:
+//
+//	code,message
+func encodeError(code int, message string) []byte {
+	b := make([]byte, 0, len(message)+8)
+	b = strconv.AppendInt(b, int64(code), 10)
+	b = append(b, ',')
+	b = append(b, message...)
+	return b
+}
+
+func decodeError(b []byte) *RemoteError {
+	i := bytes.IndexByte(b, ',')
+	if i < 0 {
+		return &RemoteError{Message: string(b)}
+	}
+	code, err := strconv.Atoi(string(b[:i]))
+	if err != nil {
+		return &RemoteError{Message: string(b)}
+	}
+	return &RemoteError{Code: code, Message: string(b[i+1:])}
+}
@@ -0,0 +1,163 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/someonegg/gox/syncx"
+	"github.com/someonegg/msgpump/v2"
+)
+
+// InitialStreamWindow is the initial flow control window (in bytes) of the
+// streams and the streaming responses.
+//
+// The sender can send messages until the window is used up, and then waits
+// for the receiver to consume them and grant more credits, so that a slow
+// receiver will not block the others sharing the same peer.
+const InitialStreamWindow = 64 << 10
+
+// credit is the send window.
+type credit struct {
+	locker sync.Mutex
+	n      int64
+	signal syncx.Event
+}
+
+func newCredit() *credit {
+	return &credit{
+		n:      InitialStreamWindow,
+		signal: syncx.NewEvent(),
+	}
+}
+
+func (c *credit) add(n int64) {
+	c.locker.Lock()
+	c.n += n
+	c.locker.Unlock()
+	c.signal.Set()
+}
+
+// acquire waits until there are credits, then consumes size of them.
+func (c *credit) acquire(ctx context.Context, size int, stopD, abortD <-chan struct{}) error {
+	for {
+		c.locker.Lock()
+		if c.n > 0 {
+			c.n -= int64(size)
+			more := c.n > 0
+			c.locker.Unlock()
+			if more {
+				// wake up the other waiters.
+				c.signal.Set()
+			}
+			return nil
+		}
+		c.locker.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-stopD:
+			return msgpump.ErrPumpStopped
+		case <-abortD:
+			return ErrStreamClosed
+		case <-c.signal:
+		}
+	}
+}
+
+// inbox is the receive queue, it grants credits to the sender after the
+// messages are consumed.
+type inbox struct {
+	locker   sync.Mutex
+	msgs     [][]byte
+	window   int64
+	consumed int64
+	avail    int64 // the credits granted to the sender and not used yet
+	signal   syncx.Event
+}
+
+func newInbox(window int) *inbox {
+	return &inbox{
+		window: int64(window),
+		avail:  int64(window),
+		signal: syncx.NewEvent(),
+	}
+}
+
+// initialGrant returns the credits to grant in addition to the initial window.
+func (in *inbox) initialGrant() int64 {
+	return in.window - InitialStreamWindow
+}
+
+// push queues the message, it returns false if the sender has no credits,
+// see credit.acquire, the message is dropped then.
+func (in *inbox) push(m []byte) bool {
+	in.locker.Lock()
+	if in.avail <= 0 {
+		in.locker.Unlock()
+		return false
+	}
+	in.avail -= int64(len(m))
+	in.msgs = append(in.msgs, m)
+	in.locker.Unlock()
+	in.signal.Set()
+	return true
+}
+
+// pop returns the first message, and the credits to grant if not zero.
+func (in *inbox) pop() (m []byte, grant int64, ok bool) {
+	in.locker.Lock()
+	defer in.locker.Unlock()
+
+	if len(in.msgs) == 0 {
+		return nil, 0, false
+	}
+	m = in.msgs[0]
+	in.msgs[0] = nil
+	in.msgs = in.msgs[1:]
+
+	in.consumed += int64(len(m))
+	if in.consumed >= in.window/2 {
+		grant = in.consumed
+		in.consumed = 0
+		in.avail += grant
+	}
+	return m, grant, true
+}
+
+// grantCredit sends the window update, scope is the side of the stream, or
+// 'q' for the streaming response.
+func (p *Peer) grantCredit(id uint64, scope byte, n int64) {
+	if n <= 0 {
+		return
+	}
+
+	h := p.header(&frame{t: 'W', id: id, side: scope, n: n})
+	p.Pump.OutputPriorityMP(context.Background(), msgpump.PriorityHigh, msgpump.MPMessage{h})
+}
+
+// onWindowUpdate handles the window update frame.
+func (p *Peer) onWindowUpdate(f *frame) {
+	if f.n <= 0 {
+		return
+	}
+
+	var c *credit
+	if f.side == 'q' {
+		p.locker.Lock()
+		if req := p.reqs[f.id]; req != nil {
+			c = req.credit
+		}
+		p.locker.Unlock()
+	} else if s := p.remoteStream(f.id, f.side); s != nil {
+		c = s.credit
+	}
+
+	if c != nil {
+		c.add(f.n)
+	}
+}
@@ -6,12 +6,10 @@ package msgpeer
 
 import (
 	"context"
-	"fmt"
-	"log"
-	"runtime"
 	"time"
 
 	"github.com/someonegg/msgpump/v2"
+	"github.com/someonegg/msgpump/v2/internal/worker"
 )
 
 type entry struct {
@@ -20,27 +18,72 @@ type entry struct {
 	w   ResponseWriter // not nil if request
 }
 
+// OverloadPolicy defines what to do when all the workers are busy and the
+// maximum is reached, see BoundedParallelHandler.
+type OverloadPolicy int
+
+const (
+	// OverloadBlock waits for an idle worker, which blocks the reading
+	// loop of the peer, so the back-pressure is applied to the remote.
+	OverloadBlock OverloadPolicy = iota
+	// OverloadReject replies the requests an error response with
+	// CodeOverloaded, and drops the notifies.
+	OverloadReject
+	// OverloadDropNotify drops the notifies, and waits for an idle worker
+	// for the requests.
+	OverloadDropNotify
+)
+
+// overloaded applies the policy to the overloaded e, it returns true if e
+// should wait for the space, or false if e is rejected or dropped.
+func (policy OverloadPolicy) overloaded(e entry) (wait bool) {
+	switch {
+	case policy == OverloadReject && e.w != nil:
+		e.w.WriteError(e.ctx, CodeOverloaded, "overloaded")
+		return false
+	case policy != OverloadBlock && e.w == nil:
+		return false
+	}
+	return true
+}
+
 type parallHandler struct {
-	h        Handler
-	idle     time.Duration
-	panicLog func(interface{})
-	entryC   chan entry
+	h      Handler
+	g      *worker.Group
+	policy OverloadPolicy
 }
 
 // ParallelHandler convert a handler to parallel mode, in which each call
 // will be initiated from a different worker goroutine.
+//
+// The workerPanicLog is optional, the default one writes to the logger of
+// the peer if set, see WithLogger, or to the log package.
+//
+// The calls whose ctx is done before initiated are dropped without reply,
+// the remote has cancelled them or they are expired.
+//
+// The number of workers is unbounded, see BoundedParallelHandler, and
+// WorkerPool to share the workers among many peers, KeyedParallelHandler
+// to keep the order of the calls with the same key.
+//
+// It works like msgpump.ParallelHandler, but knows the requests from the
+// notifies, see OverloadPolicy.
 func ParallelHandler(h Handler, workerIdleTimeout time.Duration,
 	workerPanicLog func(panicV interface{})) Handler {
 
-	if workerPanicLog == nil {
-		workerPanicLog = theWorkerPanicLogFunc
-	}
+	return BoundedParallelHandler(h, workerIdleTimeout, workerPanicLog, 0, OverloadBlock)
+}
+
+// BoundedParallelHandler is like ParallelHandler, but there are maxWorkers
+// workers at most, the policy is applied when all of them are busy. Zero
+// maxWorkers means unbounded.
+func BoundedParallelHandler(h Handler, workerIdleTimeout time.Duration,
+	workerPanicLog func(panicV interface{}), maxWorkers int, policy OverloadPolicy) Handler {
 
 	return &parallHandler{
-		h:        h,
-		idle:     workerIdleTimeout,
-		panicLog: workerPanicLog,
-		entryC:   make(chan entry),
+		h:      h,
+		g:      worker.NewGroup(workerIdleTimeout, workerPanicLog, maxWorkers),
+		policy: policy,
 	}
 }
 
@@ -53,52 +96,28 @@ func (h *parallHandler) OnNotify(ctx context.Context, n Notify) {
 }
 
 func (h *parallHandler) parall(e entry) {
-	select {
-	case <-e.ctx.Done():
-	case h.entryC <- e:
-	default:
-		go h.work(e)
+	if e.ctx.Err() != nil {
+		return
 	}
-}
 
-// The default worker panic log function.
-func theWorkerPanicLogFunc(v interface{}) {
-	const size = 16 << 10
-	buf := make([]byte, size)
-	buf = buf[:runtime.Stack(buf, false)]
-	log.Print("worker panic: ", v, fmt.Sprintf("\n%s", buf))
-}
-
-func (h *parallHandler) work(e entry) {
-	defer func() {
-		if e := recover(); e != nil {
-			h.panicLog(e)
+	f := func() {
+		if e.ctx.Err() == nil {
+			dispatch(h.h, e)
 		}
-	}()
-
-	h.handle(e)
-
-	t := time.NewTimer(h.idle)
-
-	for q := false; !q; {
-		select {
-		case e = <-h.entryC:
-			h.handle(e)
+	}
+	if h.g.TryRun(e.ctx, f) {
+		return
+	}
 
-			if !t.Stop() {
-				<-t.C
-			}
-			t.Reset(h.idle)
-		case <-t.C:
-			q = true
-		}
+	if h.policy.overloaded(e) {
+		h.g.Run(e.ctx, f)
 	}
 }
 
-func (h *parallHandler) handle(e entry) {
+func dispatch(h Handler, e entry) {
 	if e.w != nil {
-		h.h.Process(e.ctx, e.m, e.w)
+		h.Process(e.ctx, e.m, e.w)
 	} else {
-		h.h.OnNotify(e.ctx, e.m)
+		h.OnNotify(e.ctx, e.m)
 	}
 }
@@ -0,0 +1,219 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/someonegg/gox/syncx"
+	"github.com/someonegg/msgpump/v2"
+)
+
+// The protocol version range supported by this package, the peers are
+// compatible if their ranges overlap.
+const (
+	ProtocolVersion    = 1
+	MinProtocolVersion = 1
+)
+
+// The features advertised in Hello.
+const (
+	FeatureBinaryHeader = "binary-header"
+	FeatureHeartbeat    = "heartbeat"
+)
+
+var (
+	ErrHandshakeTimeout     = errors.New("msgpeer: handshake timeout")
+	ErrIncompatibleProtocol = errors.New("msgpeer: incompatible protocol")
+)
+
+// Hello is exchanged by the handshake, see WithHandshake.
+type Hello struct {
+	Version    int
+	MinVersion int
+	Features   []string
+	Metadata   Metadata // application metadata
+}
+
+// HasFeature returns whether the feature is supported.
+func (h *Hello) HasFeature(feature string) bool {
+	for _, f := range h.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+type handshake struct {
+	enabled bool
+	timeout time.Duration
+	md      Metadata
+	check   func(remote *Hello) error
+
+	locker sync.Mutex
+	sent   bool
+	remote *Hello
+	doneD  syncx.DoneChan // closed after the remote hello is accepted
+}
+
+func (p *Peer) localHello() *Hello {
+	h := &Hello{
+		Version:    ProtocolVersion,
+		MinVersion: MinProtocolVersion,
+		Metadata:   p.hs.md,
+	}
+	if p.wantBinary {
+		h.Features = append(h.Features, FeatureBinaryHeader)
+	}
+	if p.hb.interval > 0 {
+		h.Features = append(h.Features, FeatureHeartbeat)
+	}
+	return h
+}
+
+// sendHello sends the local hello if not sent yet.
+func (p *Peer) sendHello() {
+	hs := &p.hs
+	hs.locker.Lock()
+	sent := hs.sent
+	hs.sent = true
+	hs.locker.Unlock()
+	if sent {
+		return
+	}
+
+	p.Pump.OutputPriorityMP(context.Background(), msgpump.PriorityHigh,
+		msgpump.MPMessage{p.idHeader('H', 0), encodeHello(p.localHello())})
+}
+
+func (p *Peer) handshaking() {
+	var timeoutC <-chan time.Time
+	if p.hs.timeout > 0 {
+		t := time.NewTimer(p.hs.timeout)
+		defer t.Stop()
+		timeoutC = t.C
+	}
+
+	select {
+	case <-p.hs.doneD:
+	case <-p.Pump.StopD():
+	case <-timeoutC:
+		p.stop(ErrHandshakeTimeout)
+	}
+}
+
+// onHello is called from Peer.Process, the hello will be replied if not
+// sent yet, so the peer without WithHandshake can still be handshaked.
+//
+// The malformed hello is a protocol error, see WithProtocolErrorPolicy.
+func (p *Peer) onHello(m, body []byte) {
+	remote, ok := decodeHello(body)
+	if !ok {
+		p.protocolError(m, "malformed hello")
+		return
+	}
+
+	hs := &p.hs
+	hs.locker.Lock()
+	if hs.remote != nil {
+		hs.locker.Unlock()
+		return
+	}
+	hs.remote = remote
+	hs.locker.Unlock()
+
+	p.sendHello()
+
+	if remote.Version < MinProtocolVersion || remote.MinVersion > ProtocolVersion {
+		p.stop(ErrIncompatibleProtocol)
+		return
+	}
+	if hs.check != nil {
+		if err := hs.check(remote); err != nil {
+			p.stop(err)
+			return
+		}
+	}
+
+	if p.wantBinary && remote.HasFeature(FeatureBinaryHeader) {
+		atomic.StoreInt32(&p.binary, 1)
+	}
+	if p.logger != nil {
+		p.logger.Info("peer handshaked", "version", remote.Version, "features", remote.Features)
+	}
+	hs.doneD.SetDone()
+}
+
+// WaitHandshake waits for the handshake to complete, and returns the remote
+// hello, see WithHandshake.
+//
+// It returns the error of the peer if the handshake failed.
+func (p *Peer) WaitHandshake(ctx context.Context) (*Hello, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.Pump.StopD():
+		return nil, p.Error()
+	case <-p.hs.doneD:
+		p.hs.locker.Lock()
+		defer p.hs.locker.Unlock()
+		return p.hs.remote, nil
+	}
+}
+
+// The format of the hello body is:
+//
+//	version,min-version\n
+//	feature1,feature2\n
+//	metadata
+func encodeHello(h *Hello) []byte {
+	b := make([]byte, 0, 64)
+	b = strconv.AppendInt(b, int64(h.Version), 10)
+	b = append(b, ',')
+	b = strconv.AppendInt(b, int64(h.MinVersion), 10)
+	b = append(b, '\n')
+	b = append(b, strings.Join(h.Features, ",")...)
+	b = append(b, '\n')
+	b = appendMetadata(b, h.Metadata)
+	return b
+}
+
+func decodeHello(b []byte) (*Hello, bool) {
+	ls := bytes.SplitN(b, []byte{'\n'}, 3)
+	if len(ls) != 3 {
+		return nil, false
+	}
+
+	vs := strings.Split(string(ls[0]), ",")
+	if len(vs) != 2 {
+		return nil, false
+	}
+	v, err := strconv.Atoi(vs[0])
+	if err != nil {
+		return nil, false
+	}
+	mv, err := strconv.Atoi(vs[1])
+	if err != nil {
+		return nil, false
+	}
+
+	h := &Hello{
+		Version:    v,
+		MinVersion: mv,
+		Metadata:   parseMetadata(string(ls[2])),
+	}
+	if len(ls[1]) > 0 {
+		h.Features = strings.Split(string(ls[1]), ",")
+	}
+	return h, true
+}
@@ -0,0 +1,336 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// frame is the parsed message header.
+type frame struct {
+	t    byte   // the frame type, like 'R'
+	id   uint64 // request/stream/ping id
+	side byte   // for the stream frames and window update
+	n    int64  // timeout (ms) for request, credits for window update
+
+	method string
+	md     Metadata
+}
+
+// timeout returns the timeout of the request frame, or zero.
+func (f *frame) timeout() time.Duration {
+	if f.n <= 0 {
+		return 0
+	}
+	return time.Duration(f.n) * time.Millisecond
+}
+
+// timeoutMs converts the timeout to milliseconds, at least 1 if positive.
+func timeoutMs(timeout time.Duration) int64 {
+	if timeout <= 0 {
+		return 0
+	}
+	ms := timeout.Milliseconds()
+	if ms == 0 {
+		ms = 1
+	}
+	return ms
+}
+
+// appendHeader appends the header of f in the binary format if bin,
+// otherwise in the text format.
+func appendHeader(b []byte, f *frame, bin bool) []byte {
+	if bin {
+		return appendBinaryHeader(b, f)
+	}
+	return appendTextHeader(b, f)
+}
+
+// parseHeader parses the header in the text or binary format, and returns
+// the body of m.
+func parseHeader(m []byte, f *frame) (body []byte, ok bool) {
+	if len(m) == 0 {
+		return nil, false
+	}
+	if m[0]&binaryMark != 0 {
+		return parseBinaryHeader(m, f)
+	}
+	return parseTextHeader(m, f)
+}
+
+// The text format of the message header is:
+//
+//	R,request-id[,timeout[,method[,metadata]]]\n  for request, timeout is in milliseconds, 0 means no timeout
+//	Q,request-id[,timeout[,method[,metadata]]]\n  for request expecting the streaming response
+//	P,request-id\n              for response
+//	E,request-id\n              for error response, the body is "code,message"
+//	S,request-id\n              for response chunk of the stream
+//	C,request-id\n              for request cancellation
+//	N[,method[,metadata]]\n     for notify, metadata is encoded like "k1=v1&k2=v2"
+//	B,stream-id\n               for stream open
+//	D,stream-id,side\n          for stream data, side is "o" (opener) or "a" (acceptor)
+//	F,stream-id,side\n          for stream close, the body is "code,message" if error
+//	W,id,scope,credits\n        for window update, scope is the side, or "q" for request
+//	I,ping-id\n                 for heartbeat ping
+//	O,ping-id\n                 for heartbeat pong
+//	H,0\n                       for handshake hello, see Hello
+//	X,0\n                       for protocol error, the body is the reason
+//
+// The ids are in hexadecimal.
+func appendTextHeader(b []byte, f *frame) []byte {
+	b = append(b, f.t)
+
+	if f.t == 'N' {
+		if f.method != "" || len(f.md) > 0 {
+			b = append(b, ',')
+			b = append(b, f.method...)
+		}
+		if len(f.md) > 0 {
+			b = append(b, ',')
+			b = appendMetadata(b, f.md)
+		}
+		return append(b, '\n')
+	}
+
+	b = append(b, ',')
+	b = strconv.AppendUint(b, f.id, 16)
+
+	switch f.t {
+	case 'R', 'Q':
+		if f.n > 0 || f.method != "" || len(f.md) > 0 {
+			b = append(b, ',')
+			b = strconv.AppendInt(b, f.n, 10)
+		}
+		if f.method != "" || len(f.md) > 0 {
+			b = append(b, ',')
+			b = append(b, f.method...)
+		}
+		if len(f.md) > 0 {
+			b = append(b, ',')
+			b = appendMetadata(b, f.md)
+		}
+	case 'D', 'F':
+		b = append(b, ',', f.side)
+	case 'W':
+		b = append(b, ',', f.side, ',')
+		b = strconv.AppendInt(b, f.n, 10)
+	}
+	return append(b, '\n')
+}
+
+func parseTextHeader(m []byte, f *frame) (body []byte, ok bool) {
+	h := m
+	if len(h) > MaxHeaderLen {
+		h = h[:MaxHeaderLen]
+	}
+	i := bytes.IndexByte(h, '\n')
+	if i <= 0 {
+		return nil, false
+	}
+	h, body = m[:i], m[i+1:]
+
+	f.t = h[0]
+	if len(h) == 1 {
+		return body, f.t == 'N'
+	}
+	if h[1] != ',' {
+		return nil, false
+	}
+
+	ss := strings.Split(string(h[2:]), ",")
+
+	if f.t == 'N' {
+		f.method = ss[0]
+		if len(ss) > 1 {
+			f.md = parseMetadata(ss[1])
+		}
+		return body, true
+	}
+
+	id, err := strconv.ParseUint(ss[0], 16, 64)
+	if err != nil {
+		return nil, false
+	}
+	f.id = id
+
+	switch f.t {
+	case 'R', 'Q':
+		if len(ss) > 1 {
+			ms, err := strconv.ParseInt(ss[1], 10, 64)
+			if err != nil {
+				return nil, false
+			}
+			f.n = ms
+		}
+		if len(ss) > 2 {
+			f.method = ss[2]
+		}
+		if len(ss) > 3 {
+			f.md = parseMetadata(ss[3])
+		}
+	case 'D', 'F':
+		if len(ss) < 2 || len(ss[1]) != 1 {
+			return nil, false
+		}
+		f.side = ss[1][0]
+	case 'W':
+		if len(ss) < 3 || len(ss[1]) != 1 {
+			return nil, false
+		}
+		f.side = ss[1][0]
+		n, err := strconv.ParseInt(ss[2], 10, 64)
+		if err != nil {
+			return nil, false
+		}
+		f.n = n
+	}
+	return body, true
+}
+
+// binaryMark is set in the first byte of the binary header, it never
+// appears in the text header.
+const binaryMark = 0x80
+
+// The flags of the binary header.
+const (
+	flagTimeout  = 1 << iota // uvarint timeout (ms)
+	flagMethod               // uvarint length and the method name
+	flagMetadata             // uvarint count and the length-prefixed key/value pairs
+	flagSide                 // the side byte
+	flagCredits              // uvarint credits
+)
+
+// The binary format of the message header is:
+//
+//	type|0x80, uvarint id, flags, [optional fields by the flags]
+//
+// The type is the same as the text format, the id is zero for notify.
+func appendBinaryHeader(b []byte, f *frame) []byte {
+	b = append(b, f.t|binaryMark)
+	b = binary.AppendUvarint(b, f.id)
+
+	var flags byte
+	if f.n > 0 && (f.t == 'R' || f.t == 'Q') {
+		flags |= flagTimeout
+	}
+	if f.method != "" {
+		flags |= flagMethod
+	}
+	if len(f.md) > 0 {
+		flags |= flagMetadata
+	}
+	if f.side != 0 {
+		flags |= flagSide
+	}
+	if f.n > 0 && f.t == 'W' {
+		flags |= flagCredits
+	}
+	b = append(b, flags)
+
+	if flags&flagTimeout != 0 {
+		b = binary.AppendUvarint(b, uint64(f.n))
+	}
+	if flags&flagMethod != 0 {
+		b = appendBytes(b, f.method)
+	}
+	if flags&flagMetadata != 0 {
+		b = binary.AppendUvarint(b, uint64(len(f.md)))
+		for k, v := range f.md {
+			b = appendBytes(b, k)
+			b = appendBytes(b, v)
+		}
+	}
+	if flags&flagSide != 0 {
+		b = append(b, f.side)
+	}
+	if flags&flagCredits != 0 {
+		b = binary.AppendUvarint(b, uint64(f.n))
+	}
+	return b
+}
+
+func appendBytes(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// binaryReader reads the fields of the binary header, err is set if the
+// header is truncated.
+type binaryReader struct {
+	b   []byte
+	err bool
+}
+
+func (r *binaryReader) byte() byte {
+	if len(r.b) < 1 {
+		r.err = true
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *binaryReader) uvarint() uint64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = true
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *binaryReader) string() string {
+	l := r.uvarint()
+	if r.err || l > uint64(len(r.b)) {
+		r.err = true
+		return ""
+	}
+	s := string(r.b[:l])
+	r.b = r.b[l:]
+	return s
+}
+
+func parseBinaryHeader(m []byte, f *frame) (body []byte, ok bool) {
+	r := binaryReader{b: m}
+
+	f.t = r.byte() &^ binaryMark
+	f.id = r.uvarint()
+	flags := r.byte()
+
+	if flags&flagTimeout != 0 {
+		f.n = int64(r.uvarint())
+	}
+	if flags&flagMethod != 0 {
+		f.method = r.string()
+	}
+	if flags&flagMetadata != 0 {
+		n := r.uvarint()
+		if n > uint64(len(r.b)) {
+			return nil, false
+		}
+		f.md = make(Metadata, n)
+		for i := uint64(0); i < n && !r.err; i++ {
+			k := r.string()
+			f.md[k] = r.string()
+		}
+	}
+	if flags&flagSide != 0 {
+		f.side = r.byte()
+	}
+	if flags&flagCredits != 0 {
+		f.n = int64(r.uvarint())
+	}
+
+	if r.err || f.n < 0 {
+		return nil, false
+	}
+	return r.b, true
+}
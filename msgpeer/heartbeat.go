@@ -0,0 +1,98 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/someonegg/msgpump/v2"
+)
+
+type heartbeat struct {
+	interval time.Duration
+	maxMiss  int
+
+	locker  sync.Mutex
+	npid    uint64
+	pid     uint64
+	sent    time.Time
+	waiting bool
+	missed  int
+
+	rtt int64 // time.Duration
+}
+
+// RTT returns the round-trip time measured by the latest heartbeat, zero
+// if the heartbeat is disabled or no pong is received yet.
+func (p *Peer) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&p.hb.rtt))
+}
+
+func (p *Peer) heartbeating() {
+	t := time.NewTicker(p.hb.interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-p.Pump.StopD():
+			return
+		case <-t.C:
+		}
+
+		pid, ok := p.nextPing()
+		if !ok {
+			p.stop(ErrHeartbeatTimeout)
+			return
+		}
+		if pid == 0 {
+			// the last ping is still outstanding.
+			continue
+		}
+
+		p.Pump.OutputPriorityMP(context.Background(), msgpump.PriorityHigh,
+			msgpump.MPMessage{p.idHeader('I', pid)})
+	}
+}
+
+// nextPing returns the next ping id, or false if too many pings missed.
+//
+// No new ping is sent while the last one is outstanding, the interval is
+// only counted as missed, so a pong slower than the interval is accepted.
+func (p *Peer) nextPing() (uint64, bool) {
+	hb := &p.hb
+	hb.locker.Lock()
+	defer hb.locker.Unlock()
+
+	if hb.waiting {
+		hb.missed++
+		if hb.missed >= hb.maxMiss {
+			return 0, false
+		}
+		return 0, true
+	}
+
+	hb.npid++
+	hb.pid = hb.npid
+	hb.sent = time.Now()
+	hb.waiting = true
+	return hb.pid, true
+}
+
+func (p *Peer) pong(pid uint64) {
+	hb := &p.hb
+	hb.locker.Lock()
+	defer hb.locker.Unlock()
+
+	if !hb.waiting || pid != hb.pid {
+		return
+	}
+
+	atomic.StoreInt64(&hb.rtt, int64(time.Since(hb.sent)))
+	hb.waiting = false
+	hb.missed = 0
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+)
+
+// Invoker sends the request and waits for the response, see Peer.Do.
+type Invoker func(ctx context.Context, r Request) (Response, error)
+
+// ClientInterceptor intercepts Peer.Do, it should call invoker to continue,
+// see WithClientInterceptors.
+type ClientInterceptor func(ctx context.Context, r Request, invoker Invoker) (Response, error)
+
+// ServerInterceptor intercepts Handler.Process, it should call next to
+// continue, see WithServerInterceptors.
+type ServerInterceptor func(ctx context.Context, r Request, w ResponseWriter, next HandlerFunc)
+
+// NotifyInterceptor intercepts Handler.OnNotify, it should call next to
+// continue, see WithServerInterceptors.
+type NotifyInterceptor func(ctx context.Context, n Notify, next NotifyFunc)
+
+func chainClient(ics []ClientInterceptor, invoker Invoker) Invoker {
+	for i := len(ics) - 1; i >= 0; i-- {
+		ic, next := ics[i], invoker
+		invoker = func(ctx context.Context, r Request) (Response, error) {
+			return ic(ctx, r, next)
+		}
+	}
+	return invoker
+}
+
+type interceptHandler struct {
+	process HandlerFunc
+	notify  NotifyFunc
+}
+
+// InterceptHandler returns a handler which calls h through the interceptors,
+// the first one is the outermost.
+//
+// It can be composed with the other handlers, like
+// ParallelHandler(InterceptHandler(mux, ...), ...) to run the interceptors
+// in the worker goroutines.
+func InterceptHandler(h Handler, process []ServerInterceptor, notify []NotifyInterceptor) Handler {
+	ih := &interceptHandler{
+		process: h.Process,
+		notify:  h.OnNotify,
+	}
+	for i := len(process) - 1; i >= 0; i-- {
+		ic, next := process[i], ih.process
+		ih.process = func(ctx context.Context, r Request, w ResponseWriter) {
+			ic(ctx, r, w, next)
+		}
+	}
+	for i := len(notify) - 1; i >= 0; i-- {
+		ic, next := notify[i], ih.notify
+		ih.notify = func(ctx context.Context, n Notify) {
+			ic(ctx, n, next)
+		}
+	}
+	return ih
+}
+
+func (h *interceptHandler) Process(ctx context.Context, r Request, w ResponseWriter) {
+	h.process(ctx, r, w)
+}
+
+func (h *interceptHandler) OnNotify(ctx context.Context, n Notify) {
+	h.notify(ctx, n)
+}
@@ -0,0 +1,148 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/someonegg/gox/syncx"
+	"github.com/someonegg/msgpump/v2"
+	"github.com/someonegg/msgpump/v2/internal/worker"
+)
+
+// KeyFunc extracts the ordering key of the request or notify, like the
+// session id from the payload, see KeyedParallelHandler.
+type KeyFunc func(ctx context.Context, m msgpump.Message) string
+
+type keyQueue struct {
+	pending []entry
+}
+
+type keyedHandler struct {
+	h        Handler
+	key      KeyFunc
+	g        *worker.Group
+	panicLog func(interface{})
+	max      int
+	policy   OverloadPolicy
+	space    syncx.Event
+
+	locker sync.Mutex
+	queues map[string]*keyQueue // the keys being processed
+	n      int                  // the calls queued or being processed
+}
+
+// KeyedParallelHandler convert a handler to keyed parallel mode, in which
+// the calls with the same key are initiated in order from the same worker
+// goroutine, and the calls with different keys are initiated in parallel.
+//
+// A worker exits after idle for workerIdleTimeout, and the workerPanicLog
+// is optional, see ParallelHandler.
+//
+// There are maxPending calls queued or being processed at most, the policy
+// is applied when exceeded. Zero maxPending means unbounded.
+//
+// The calls whose ctx is done are dropped like ParallelHandler.
+func KeyedParallelHandler(h Handler, key KeyFunc, workerIdleTimeout time.Duration,
+	workerPanicLog func(panicV interface{}), maxPending int, policy OverloadPolicy) Handler {
+
+	return &keyedHandler{
+		h:        h,
+		key:      key,
+		g:        worker.NewGroup(workerIdleTimeout, workerPanicLog, 0),
+		panicLog: workerPanicLog,
+		max:      maxPending,
+		policy:   policy,
+		space:    syncx.NewEvent(),
+		queues:   make(map[string]*keyQueue),
+	}
+}
+
+func (h *keyedHandler) Process(ctx context.Context, r Request, w ResponseWriter) {
+	h.parall(entry{ctx, r, w})
+}
+
+func (h *keyedHandler) OnNotify(ctx context.Context, n Notify) {
+	h.parall(entry{ctx, n, nil})
+}
+
+func (h *keyedHandler) parall(e entry) {
+	k := h.key(e.ctx, e.m)
+
+	for !h.push(k, e) {
+		if !h.policy.overloaded(e) {
+			return
+		}
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-h.space:
+		}
+	}
+}
+
+// push queues the entry of k, and runs a worker to drain the queue of k if
+// not running. It returns false if the pending calls exceed.
+func (h *keyedHandler) push(k string, e entry) bool {
+	h.locker.Lock()
+	defer h.locker.Unlock()
+
+	if h.max > 0 && h.n >= h.max {
+		return false
+	}
+	h.n++
+
+	if q := h.queues[k]; q != nil {
+		q.pending = append(q.pending, e)
+		return true
+	}
+
+	q := &keyQueue{pending: []entry{e}}
+	h.queues[k] = q
+	h.g.TryRun(e.ctx, func() { h.drain(k, q) }) // unbounded
+	return true
+}
+
+// done is called after a call of the key is processed.
+func (h *keyedHandler) done() {
+	h.locker.Lock()
+	h.n--
+	h.locker.Unlock()
+	h.space.Set()
+}
+
+// drain handles the queued calls of k in order until none left.
+func (h *keyedHandler) drain(k string, q *keyQueue) {
+	for {
+		h.locker.Lock()
+		if len(q.pending) == 0 {
+			delete(h.queues, k)
+			h.locker.Unlock()
+			return
+		}
+		e := q.pending[0]
+		q.pending[0] = entry{}
+		q.pending = q.pending[1:]
+		h.locker.Unlock()
+
+		h.handle(e)
+	}
+}
+
+func (h *keyedHandler) handle(e entry) {
+	defer h.done()
+	defer func() {
+		if v := recover(); v != nil {
+			worker.Recovered(e.ctx, h.panicLog, v)
+		}
+	}()
+
+	if e.ctx.Err() == nil {
+		dispatch(h.h, e)
+	}
+}
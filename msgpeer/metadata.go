@@ -0,0 +1,88 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Metadata is the key/value pairs sent with the request or notify, such as
+// trace ids, auth tokens, or tenant ids.
+//
+// The encoded metadata, with the other header fields, can not exceed
+// MaxHeaderLen.
+type Metadata map[string]string
+
+type metadataKey struct{}
+type incomingMetadataKey struct{}
+
+// WithMetadata returns a copy of ctx with the metadata, which will be sent
+// with the request or notify by Peer.Do, Peer.DoStream and Peer.Notify.
+//
+// To propagate the incoming metadata, use WithMetadata(ctx, MetadataFrom(ctx)).
+func WithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFrom returns the metadata of the processing request or notify, it
+// is nil if the remote did not send any.
+func MetadataFrom(ctx context.Context) Metadata {
+	md, _ := ctx.Value(incomingMetadataKey{}).(Metadata)
+	return md
+}
+
+// outgoingMetadata returns the metadata set by WithMetadata.
+func outgoingMetadata(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+// appendMetadata appends the metadata encoded like the URL query, the keys
+// are sorted.
+func appendMetadata(b []byte, md Metadata) []byte {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for i, k := range keys {
+		if i > 0 {
+			b = append(b, '&')
+		}
+		b = append(b, url.QueryEscape(k)...)
+		b = append(b, '=')
+		b = append(b, url.QueryEscape(md[k])...)
+	}
+	return b
+}
+
+// parseMetadata parses the encoded metadata, the malformed pairs are ignored.
+func parseMetadata(s string) Metadata {
+	if s == "" {
+		return nil
+	}
+
+	md := make(Metadata)
+	for _, kv := range strings.Split(s, "&") {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		k, err := url.QueryUnescape(kv[:i])
+		if err != nil {
+			continue
+		}
+		v, err := url.QueryUnescape(kv[i+1:])
+		if err != nil {
+			continue
+		}
+		md[k] = v
+	}
+	return md
+}
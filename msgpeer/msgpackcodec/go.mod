@@ -0,0 +1,13 @@
+module github.com/someonegg/msgpump/v2/msgpeer/msgpackcodec
+
+go 1.21
+
+require (
+	github.com/someonegg/msgpump/v2 v2.1.0 // the first version with msgpeer.Codec
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+)
+
+require (
+	github.com/someonegg/gox v1.0.5 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+)
@@ -0,0 +1,24 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package msgpackcodec implements the msgpeer.Codec with msgpack.
+package msgpackcodec
+
+import (
+	"github.com/someonegg/msgpump/v2/msgpeer"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+type codec struct{}
+
+// Codec is the msgpeer.Codec using msgpack.
+var Codec msgpeer.Codec = codec{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
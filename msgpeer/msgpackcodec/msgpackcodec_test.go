@@ -0,0 +1,25 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpackcodec
+
+import (
+	"testing"
+)
+
+type point struct {
+	X, Y int
+}
+
+func TestCodec(t *testing.T) {
+	b, err := Codec.Marshal(point{1, 2})
+	if err != nil {
+		t.Fatal("marshal", err)
+	}
+
+	var p point
+	if err := Codec.Unmarshal(b, &p); err != nil || p != (point{1, 2}) {
+		t.Fatal("unmarshal", p, err)
+	}
+}
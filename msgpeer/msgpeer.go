@@ -6,10 +6,14 @@ package msgpeer
 
 import (
 	"context"
-	"strconv"
+	"errors"
+	"log/slog"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/someonegg/gox/syncx"
 	"github.com/someonegg/msgpump/v2"
 )
 
@@ -17,6 +21,7 @@ type Request = msgpump.Message
 type Response = msgpump.Message
 type Notify = msgpump.Message
 
+// ResponseWriter writes the response with the priority of ctx, see WithPriority.
 type ResponseWriter func(ctx context.Context, resp Response) error
 
 // Handler is the request processor.
@@ -25,6 +30,16 @@ type ResponseWriter func(ctx context.Context, resp Response) error
 // You can process requests asynchronously if necessary, it is safe to read
 // them after returning.
 //
+// The requests and notifies are queued for the handler, so a slow handler
+// will not block the responses, the stream messages and the cancellations,
+// until the backlog is full, see WithHandlerBacklog. They are not flow
+// controlled like the streams, the reading loop stalls after the backlog is
+// full, and so do the responses and the stream messages behind them. Use
+// ParallelHandler or WorkerPool if the handler is slow.
+//
+// The ctx passed to Process will be cancelled if the remote cancels the
+// request, the request should always be replied by the ResponseWriter.
+//
 // See ParallelHandler too.
 type Handler interface {
 	Process(ctx context.Context, r Request, w ResponseWriter)
@@ -32,136 +47,579 @@ type Handler interface {
 	OnNotify(ctx context.Context, n Notify)
 }
 
+// DefaultHandlerBacklog is the default maximum number of requests and
+// notifies waiting for the handler, see WithHandlerBacklog.
+const DefaultHandlerBacklog = 64
+
+type priorityKey struct{}
+
+// WithPriority returns a copy of ctx with the write priority, which will
+// be used by Peer.Do, Peer.Notify and ResponseWriter.
+func WithPriority(ctx context.Context, pri msgpump.Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, pri)
+}
+
+func priority(ctx context.Context) msgpump.Priority {
+	if pri, ok := ctx.Value(priorityKey{}).(msgpump.Priority); ok {
+		return pri
+	}
+	return msgpump.PriorityNormal
+}
+
+type methodKey struct{}
+type incomingMethodKey struct{}
+
+// WithMethod returns a copy of ctx with the method name, which will be sent
+// with the request or notify by Peer.Do, Peer.DoStream and Peer.Notify.
+//
+// The method name can not contain ',' or '\n', see ServeMux.
+func WithMethod(ctx context.Context, method string) context.Context {
+	return context.WithValue(ctx, methodKey{}, method)
+}
+
+// Method returns the method name of the processing request or notify, it is
+// empty if the remote did not specify one.
+func Method(ctx context.Context) string {
+	m, _ := ctx.Value(incomingMethodKey{}).(string)
+	return m
+}
+
+// outgoingMethod returns the method name set by WithMethod.
+func outgoingMethod(ctx context.Context) (string, error) {
+	m, _ := ctx.Value(methodKey{}).(string)
+	if len(m) > MaxMethodLen || strings.ContainsAny(m, ",\n") {
+		return "", ErrInvalidMethod
+	}
+	return m, nil
+}
+
+type responseKindKey struct{}
+
+type responseKind int
+
+const (
+	normalResponse responseKind = iota
+	errorResponse
+	chunkResponse
+)
+
+func responseKindOf(ctx context.Context) responseKind {
+	k, _ := ctx.Value(responseKindKey{}).(responseKind)
+	return k
+}
+
+type reply struct {
+	resp  Response
+	err   error
+	chunk bool
+}
+
+type call struct {
+	replyC chan reply // for Do
+
+	// for DoStream
+	in     *inbox
+	final  reply
+	finD   syncx.DoneChan // closed after final is set
+	closeD syncx.DoneChan // closed after the stream is closed
+}
+
+// request is the processing remote request.
+type request struct {
+	cancel context.CancelFunc
+	doneC  <-chan struct{}
+	credit *credit // for the streaming response
+}
+
+var (
+	ErrHeartbeatTimeout = errors.New("msgpeer: heartbeat timeout")
+	ErrFlowControl      = errors.New("msgpeer: flow control window exceeded")
+	ErrInvalidMethod    = errors.New("msgpeer: invalid method")
+	ErrHeaderTooLarge   = errors.New("msgpeer: header too large")
+)
+
+// MaxHeaderLen is the maximum length of the message header, including the
+// method name and the metadata.
+const MaxHeaderLen = 4 << 10
+
+// MaxMethodLen is the maximum length of the method name, see WithMethod.
+const MaxMethodLen = 64
+
 type Peer struct {
 	*msgpump.Pump
-	h Handler
+	h      Handler
+	invoke Invoker
 
 	locker sync.Mutex
 	nrid   uint64
-	resps  map[string]chan Response
+	resps  map[uint64]*call
+	reqs   map[uint64]*request
+
+	window int
+	codec  Codec
+
+	wantBinary bool  // WithBinaryHeader
+	binary     int32 // 1 if sending the binary header
+
+	handleC chan entry // to the handler, see WithHandlerBacklog
+
+	nsid    uint64
+	streams map[streamKey]*Stream
+	acceptC chan *Stream
+
+	hb heartbeat
+	hs handshake
+
+	protoPolicy ProtocolErrorPolicy
+	onProtoErr  func(err *ProtocolError)
+
+	logger *slog.Logger
+
+	stopOnce sync.Once // for the stopping log
 }
 
 // NewPeer will create the message-pump with rw and writeQueueSize.
 //
 // The write methods of msgpump.Pump like Output and Post should not be called.
+//
+// It is a shortcut of NewPeerWithOptions.
 func NewPeer(rw msgpump.MessageReadWriter, h Handler, writeQueueSize int) *Peer {
+	return NewPeerWithOptions(rw, h,
+		WithPumpOptions(msgpump.WithWriteQueueSize(writeQueueSize)))
+}
+
+// NewPeerWithOptions will create the message-pump with rw, and configure
+// the peer by opts.
+//
+// The write methods of msgpump.Pump like Output and Post should not be called.
+func NewPeerWithOptions(rw msgpump.MessageReadWriter, h Handler, opts ...Option) *Peer {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.streamWindow < InitialStreamWindow {
+		o.streamWindow = InitialStreamWindow
+	}
+	if o.codec == nil {
+		o.codec = JSONCodec
+	}
+	if o.handlerBacklog <= 0 {
+		o.handlerBacklog = DefaultHandlerBacklog
+	}
+	if len(o.serverICs) > 0 || len(o.notifyICs) > 0 {
+		h = InterceptHandler(h, o.serverICs, o.notifyICs)
+	}
+
 	p := &Peer{
 		h:     h,
-		resps: make(map[string]chan Response),
+		resps: make(map[uint64]*call),
+		reqs:  make(map[uint64]*request),
+
+		window: o.streamWindow,
+		codec:  o.codec,
+
+		wantBinary: o.binaryHeader,
+
+		handleC: make(chan entry, o.handlerBacklog),
+
+		streams: make(map[streamKey]*Stream),
+		acceptC: make(chan *Stream, StreamAcceptBacklog),
+
+		hb: heartbeat{
+			interval: o.hbInterval,
+			maxMiss:  o.hbMaxMiss,
+		},
+		protoPolicy: o.protoPolicy,
+		onProtoErr:  o.onProtoErr,
+
+		hs: handshake{
+			enabled: o.handshake,
+			timeout: o.hsTimeout,
+			md:      o.hsMetadata,
+			check:   o.hsCheck,
+			doneD:   syncx.NewDoneChan(),
+		},
+	}
+	if o.binaryHeader && !o.handshake {
+		p.binary = 1
 	}
-	p.Pump = msgpump.NewPump(rw, p, writeQueueSize)
+	p.invoke = chainClient(o.clientICs, p.do)
+	p.Pump = msgpump.NewPumpWithOptions(rw, p, o.pumpOpts...)
+	p.logger = p.Pump.Logger()
 	return p
 }
 
+// Start will start the message-pump, the handler goroutine, and the
+// heartbeat and the handshake if enabled.
+func (p *Peer) Start(parent context.Context) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	p.Pump.Start(context.WithValue(parent, codecKey{}, p.codec))
+	go p.handling()
+
+	if p.hs.enabled {
+		p.sendHello()
+		go p.handshaking()
+	}
+
+	if p.hb.interval > 0 {
+		go p.heartbeating()
+	}
+}
+
+// stop stops the peer with err, which will be returned by Error. It is
+// ignored if the peer is already stopped.
+func (p *Peer) stop(err error) {
+	if p.Pump.Stopped() {
+		return
+	}
+	p.stopOnce.Do(func() {
+		if p.logger != nil {
+			p.logger.Warn("peer stopping", "error", err)
+		}
+	})
+	p.Pump.StopWithError(err)
+}
+
 // Do will send the request and wait for a response.
+//
+// The request is written with the priority of ctx, see WithPriority, the
+// method name of ctx, see WithMethod, and the metadata of ctx, see
+// WithMetadata.
+//
+// If the remote handler replies an error response, a *RemoteError will be
+// returned.
+//
+// If ctx is done before the response arrives, the request will be cancelled,
+// and the ctx of the remote handler will be cancelled too.
+//
+// The deadline of ctx is sent with the request, the ctx of the remote handler
+// will have the same deadline (measured by the remote clock).
+//
+// The request is sent through the client interceptors, see
+// WithClientInterceptors.
 func (p *Peer) Do(ctx context.Context, r Request) (Response, error) {
-	respC := make(chan Response, 1)
+	return p.invoke(ctx, r)
+}
 
-	p.locker.Lock()
-	p.nrid++
-	rid := strconv.FormatUint(p.nrid, 16)
-	p.resps[rid] = respC
-	p.locker.Unlock()
+func (p *Peer) do(ctx context.Context, r Request) (Response, error) {
+	c := &call{replyC: make(chan reply, 1)}
+	rid := p.addCall(c)
 
 	added := true
 	defer func() {
 		if added {
-			p.locker.Lock()
-			delete(p.resps, rid)
-			p.locker.Unlock()
+			p.removeCall(rid)
 		}
 	}()
 
-	err := p.Pump.OutputMP(ctx, msgpump.MPMessage{requestHeader(rid), r})
+	err := p.sendRequest(ctx, 'R', rid, r)
 	if err != nil {
 		return nil, err
 	}
 
 	select {
 	case <-ctx.Done():
+		p.cancelRequest(rid)
 		return nil, ctx.Err()
 	case <-p.Pump.StopD():
 		return nil, msgpump.ErrPumpStopped
-	case resp := <-respC:
+	case rep := <-c.replyC:
 		added = false
-		return resp, nil
+		return rep.resp, rep.err
 	}
 }
 
-// Notify will post the notify.
+func (p *Peer) addCall(c *call) uint64 {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+
+	p.nrid++
+	rid := p.nrid
+	p.resps[rid] = c
+	return rid
+}
+
+func (p *Peer) removeCall(rid uint64) {
+	p.locker.Lock()
+	delete(p.resps, rid)
+	p.locker.Unlock()
+}
+
+// sendRequest sends the request, t is 'R' for Do, 'Q' for DoStream.
+func (p *Peer) sendRequest(ctx context.Context, t byte, rid uint64, r Request) error {
+	method, err := outgoingMethod(ctx)
+	if err != nil {
+		return err
+	}
+
+	var timeout time.Duration
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+		if timeout <= 0 {
+			return context.DeadlineExceeded
+		}
+	}
+
+	h := p.header(&frame{
+		t:      t,
+		id:     rid,
+		n:      timeoutMs(timeout),
+		method: method,
+		md:     outgoingMetadata(ctx),
+	})
+	if len(h) > MaxHeaderLen {
+		return ErrHeaderTooLarge
+	}
+	return p.Pump.OutputPriorityMP(ctx, priority(ctx), msgpump.MPMessage{h, r})
+}
+
+// cancelRequest tells the remote handler that the request is cancelled,
+// it is ignored if the write queue is full.
+func (p *Peer) cancelRequest(rid uint64) {
+	m := msgpump.MPMessage{p.idHeader('C', rid)}
+	if !p.Pump.TryOutputPriorityMP(msgpump.PriorityHigh, m) {
+		// the write queue is full, the cancellation should not be lost,
+		// it waits until the pump stopped at most.
+		go p.Pump.OutputPriorityMP(context.Background(), msgpump.PriorityHigh, m)
+	}
+}
+
+// Notify will post the notify with the priority of ctx, see WithPriority,
+// the method name of ctx, see WithMethod, and the metadata of ctx, see
+// WithMetadata.
 func (p *Peer) Notify(ctx context.Context, n Notify) error {
-	h := []byte("N\n")
-	return p.Pump.OutputMP(ctx, msgpump.MPMessage{h, n})
+	method, err := outgoingMethod(ctx)
+	if err != nil {
+		return err
+	}
+
+	h := p.header(&frame{t: 'N', method: method, md: outgoingMetadata(ctx)})
+	if len(h) > MaxHeaderLen {
+		return ErrHeaderTooLarge
+	}
+	return p.Pump.OutputPriorityMP(ctx, priority(ctx), msgpump.MPMessage{h, n})
 }
 
 // Process implements the msgpump.Handler interface.
 //
-// The format of the message header is:
+// The message header is in the text or binary format, see WithBinaryHeader.
 //
-//	R,request-id\n    for request
-//	P,request-id\n    for response
-//	N\n               for notify
+// The malformed or unknown frames are handled by the policy, see
+// WithProtocolErrorPolicy.
 func (p *Peer) Process(ctx context.Context, m msgpump.Message) {
-	const MaxHeader = 128
-
-	var h []byte
-	var r []byte
-	for i := 0; i < len(m) && i < MaxHeader; i++ {
-		if m[i] == '\n' {
-			h = m[0:i]
-			r = m[i+1:]
-			break
+	var f frame
+	r, ok := parseHeader(m, &f)
+	if !ok {
+		p.protocolError(m, "malformed header")
+		return
+	}
+
+	switch f.t {
+	case 'N':
+		p.enqueue(ctx, entry{withIncoming(ctx, &f), r, nil})
+	case 'R', 'Q':
+		rid := f.id
+		var rctx context.Context
+		var cancel context.CancelFunc
+		if timeout := f.timeout(); timeout > 0 {
+			rctx, cancel = context.WithTimeout(ctx, timeout)
+		} else {
+			rctx, cancel = context.WithCancel(ctx)
+		}
+		rctx = withIncoming(rctx, &f)
+		req := &request{cancel: cancel, doneC: rctx.Done()}
+		if f.t == 'Q' {
+			req.credit = newCredit()
+		}
+		p.locker.Lock()
+		p.reqs[rid] = req
+		p.locker.Unlock()
+		// the request may be dropped by the handler without replying
+		// after rctx is done, e.g. it expired in the pending queue.
+		context.AfterFunc(rctx, func() { p.dropRequest(rid, req) })
+		p.enqueue(ctx, entry{rctx, r, p.responseWriter(rid)})
+	case 'C':
+		if req := p.finishRequest(f.id); req != nil {
+			req.cancel()
+		}
+	case 'W':
+		p.onWindowUpdate(&f)
+	case 'P':
+		p.reply(f.id, reply{resp: r})
+	case 'E':
+		p.reply(f.id, reply{err: decodeError(r)})
+	case 'S':
+		if !p.reply(f.id, reply{resp: r, chunk: true}) {
+			p.protocolError(m, "flow control window exceeded")
 		}
+	case 'B', 'D', 'F':
+		if !p.onStreamFrame(&f, r) {
+			p.protocolError(m, "flow control window exceeded")
+		}
+	case 'I':
+		p.Pump.OutputPriorityMP(ctx, msgpump.PriorityHigh, msgpump.MPMessage{p.idHeader('O', f.id)})
+	case 'O':
+		p.pong(f.id)
+	case 'H':
+		p.onHello(m, r)
+	case 'X':
+		p.onRemoteProtocolError(r)
+	default:
+		p.protocolError(m, "unknown frame type")
 	}
+}
 
-	if len(h) == 0 {
-		return
+// enqueue queues the request or notify for the handler, it waits if the
+// backlog is full, see WithHandlerBacklog.
+func (p *Peer) enqueue(ctx context.Context, e entry) {
+	select {
+	case p.handleC <- e:
+	case <-ctx.Done():
 	}
-	if len(h) == 1 && h[0] == 'N' {
-		p.h.OnNotify(ctx, r)
-		return
+}
+
+// handling calls the handler serially, the panic will stop the pump like
+// the one from the reading loop, see msgpump.Pump.StopWithPanic.
+func (p *Peer) handling() {
+	defer func() {
+		if v := recover(); v != nil {
+			p.Pump.StopWithPanic(v)
+		}
+	}()
+
+	for {
+		select {
+		case <-p.Pump.StopD():
+			return
+		case e := <-p.handleC:
+			dispatch(p.h, e)
+		}
 	}
+}
 
-	ss := strings.SplitN(string(h), ",", 3)
+// finishRequest removes and returns the processing remote request, or nil
+// if not found.
+func (p *Peer) finishRequest(rid uint64) *request {
+	p.locker.Lock()
+	defer p.locker.Unlock()
 
-	switch ss[0] {
-	case "R":
-		rid := ss[1]
-		p.h.Process(ctx, r,
-			func(ctx context.Context, resp Response) error {
-				return p.Pump.OutputMP(ctx, msgpump.MPMessage{responseHeader(rid), resp})
-			})
-	case "P":
-		rid := ss[1]
-		p.locker.Lock()
-		respC := p.resps[rid]
-		if respC != nil {
+	req := p.reqs[rid]
+	delete(p.reqs, rid)
+	return req
+}
+
+// dropRequest removes the remote request if it is still processing.
+func (p *Peer) dropRequest(rid uint64, req *request) {
+	p.locker.Lock()
+	if p.reqs[rid] == req {
+		delete(p.reqs, rid)
+	}
+	p.locker.Unlock()
+	req.cancel()
+}
+
+func (p *Peer) responseWriter(rid uint64) ResponseWriter {
+	return func(ctx context.Context, resp Response) error {
+		kind := responseKindOf(ctx)
+
+		if kind == chunkResponse {
+			p.locker.Lock()
+			req := p.reqs[rid]
+			p.locker.Unlock()
+			if req == nil {
+				return context.Canceled
+			}
+			if req.credit == nil {
+				// the caller used Do.
+				return nil
+			}
+			err := req.credit.acquire(ctx, len(resp), p.Pump.StopD(), req.doneC)
+			if err == ErrStreamClosed {
+				err = context.Canceled
+			}
+			if err != nil {
+				return err
+			}
+			return p.Pump.OutputPriorityMP(ctx, priority(ctx), msgpump.MPMessage{p.idHeader('S', rid), resp})
+		}
+
+		req := p.finishRequest(rid)
+		if req == nil {
+			// cancelled by the remote or replied already.
+			return context.Canceled
+		}
+		defer req.cancel()
+
+		t := byte('P')
+		if kind == errorResponse {
+			t = 'E'
+		}
+		h := p.idHeader(t, rid)
+		return p.Pump.OutputPriorityMP(ctx, priority(ctx), msgpump.MPMessage{h, resp})
+	}
+}
+
+// reply delivers the reply to the call, it returns false if the chunk
+// exceeds the flow control window, then the call is ended with
+// ErrFlowControl.
+func (p *Peer) reply(rid uint64, rep reply) bool {
+	p.locker.Lock()
+	c := p.resps[rid]
+	if c != nil && !rep.chunk {
+		delete(p.resps, rid)
+	}
+	p.locker.Unlock()
+
+	if c == nil {
+		return true
+	}
+
+	if c.in == nil {
+		if !rep.chunk {
 			select {
-			case respC <- r:
+			case c.replyC <- rep:
 			default:
 			}
-			delete(p.resps, rid)
 		}
-		p.locker.Unlock()
+		return true
+	}
+
+	if rep.chunk {
+		if c.in.push(rep.resp) {
+			return true
+		}
+		p.removeCall(rid)
+		p.cancelRequest(rid)
+		c.final = reply{err: ErrFlowControl}
+		c.finD.SetDone()
+		return false
+	}
+	c.final = rep
+	c.finD.SetDone()
+	return true
+}
+
+// withIncoming returns a copy of ctx with the incoming method name and
+// metadata of f.
+func withIncoming(ctx context.Context, f *frame) context.Context {
+	if f.method != "" {
+		ctx = context.WithValue(ctx, incomingMethodKey{}, f.method)
+	}
+	if len(f.md) > 0 {
+		ctx = context.WithValue(ctx, incomingMetadataKey{}, f.md)
 	}
+	return ctx
 }
 
-func requestHeader(rid string) []byte {
-	l := len(rid) + 3
-	h := make([]byte, l)
-	h[0] = 'R'
-	h[1] = ','
-	copy(h[2:], rid)
-	h[l-1] = '\n'
-	return h
+// header formats the header of f in the format of the peer.
+func (p *Peer) header(f *frame) []byte {
+	bin := atomic.LoadInt32(&p.binary) == 1
+	return appendHeader(make([]byte, 0, 16+len(f.method)), f, bin)
 }
 
-func responseHeader(rid string) []byte {
-	l := len(rid) + 3
-	h := make([]byte, l)
-	h[0] = 'P'
-	h[1] = ','
-	copy(h[2:], rid)
-	h[l-1] = '\n'
-	return h
+// idHeader formats the header like "T,id\n".
+func (p *Peer) idHeader(t byte, id uint64) []byte {
+	return p.header(&frame{t: t, id: id})
 }
@@ -0,0 +1,1333 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/someonegg/msgpump/v2"
+)
+
+type echoHandler struct{}
+
+func (echoHandler) Process(ctx context.Context, r Request, w ResponseWriter) {
+	w(ctx, r)
+}
+
+func (echoHandler) OnNotify(ctx context.Context, n Notify) {}
+
+type funcHandler struct {
+	process func(ctx context.Context, r Request, w ResponseWriter)
+	notify  func(ctx context.Context, n Notify)
+}
+
+func (h funcHandler) Process(ctx context.Context, r Request, w ResponseWriter) {
+	h.process(ctx, r, w)
+}
+
+func (h funcHandler) OnNotify(ctx context.Context, n Notify) {
+	if h.notify != nil {
+		h.notify(ctx, n)
+	}
+}
+
+func startPeers(h1, h2 Handler, opts ...Option) (*Peer, *Peer) {
+	c1, c2 := net.Pipe()
+	p1 := NewPeerWithOptions(msgpump.NetconnMRW(c1), h1, opts...)
+	p2 := NewPeerWithOptions(msgpump.NetconnMRW(c2), h2, opts...)
+	p1.Start(nil)
+	p2.Start(nil)
+	return p1, p2
+}
+
+// startSilent starts a peer whose remote side reads but never replies.
+func startSilent(h Handler, opts ...Option) *Peer {
+	c1, c2 := net.Pipe()
+	go func() {
+		rw := msgpump.NetconnMRW(c2)
+		for {
+			if _, err := rw.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	p := NewPeerWithOptions(msgpump.NetconnMRW(c1), h, opts...)
+	p.Start(nil)
+	return p
+}
+
+func TestPeerDo(t *testing.T) {
+	p1, p2 := startPeers(echoHandler{}, echoHandler{})
+	defer p1.Stop()
+	defer p2.Stop()
+
+	resp, err := p1.Do(context.Background(), []byte("hello"))
+	if err != nil || string(resp) != "hello" {
+		t.Fatal("do", string(resp), err)
+	}
+
+	resp, err = p2.Do(WithPriority(context.Background(), msgpump.PriorityHigh), []byte("world"))
+	if err != nil || string(resp) != "world" {
+		t.Fatal("do", string(resp), err)
+	}
+}
+
+func TestPeerHeartbeat(t *testing.T) {
+	p1, p2 := startPeers(echoHandler{}, echoHandler{}, WithHeartbeat(5*time.Millisecond, 3))
+	defer p1.Stop()
+	defer p2.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if p1.Stopped() || p2.Stopped() {
+		t.Fatal("heartbeat stopped")
+	}
+	if p1.RTT() <= 0 || p2.RTT() <= 0 {
+		t.Fatal("heartbeat rtt", p1.RTT(), p2.RTT())
+	}
+}
+
+func TestPeerHeartbeatTimeout(t *testing.T) {
+	p := startSilent(echoHandler{}, WithHeartbeat(5*time.Millisecond, 3))
+
+	select {
+	case <-p.StopD():
+	case <-time.After(1 * time.Second):
+		t.Fatal("heartbeat timeout")
+	}
+
+	if err := p.Error(); err != ErrHeartbeatTimeout {
+		t.Fatal("heartbeat timeout error", err)
+	}
+}
+
+func TestPeerHeartbeatSlowPong(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		// answers the pings after 3 intervals.
+		rw := msgpump.NetconnMRW(c2)
+		for {
+			m, err := rw.ReadMessage()
+			if err != nil {
+				return
+			}
+			if m[0] == 'I' {
+				time.Sleep(15 * time.Millisecond)
+				m[0] = 'O'
+				rw.WriteMessage(m)
+			}
+		}
+	}()
+	p := NewPeerWithOptions(msgpump.NetconnMRW(c1), echoHandler{}, WithHeartbeat(5*time.Millisecond, 5))
+	p.Start(nil)
+	defer p.Stop()
+
+	time.Sleep(100 * time.Millisecond)
+
+	if p.Stopped() {
+		t.Fatal("heartbeat stopped", p.Error())
+	}
+	if p.RTT() < 15*time.Millisecond {
+		t.Fatal("heartbeat rtt", p.RTT())
+	}
+}
+
+func TestPeerErrorResponse(t *testing.T) {
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		w.WriteError(ctx, 404, "not, found")
+	}}
+	p1, p2 := startPeers(echoHandler{}, h)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	_, err := p1.Do(context.Background(), []byte("hello"))
+	re, ok := err.(*RemoteError)
+	if !ok || re.Code != 404 || re.Message != "not, found" {
+		t.Fatal("error response", err)
+	}
+}
+
+func TestPeerCancel(t *testing.T) {
+	cancelled := make(chan error, 1)
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		go func() {
+			<-ctx.Done()
+			cancelled <- w(ctx, r)
+		}()
+	}}
+	p1, p2 := startPeers(echoHandler{}, h)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	_, err := p1.Do(ctx, []byte("hello"))
+	if err != context.Canceled {
+		t.Fatal("do", err)
+	}
+
+	select {
+	case err := <-cancelled:
+		if err != context.Canceled {
+			t.Fatal("write after cancel", err)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("remote cancel")
+	}
+}
+
+func TestPeerCancelQueueFull(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	p := NewPeerWithOptions(msgpump.NetconnMRW(c1), echoHandler{},
+		WithPumpOptions(msgpump.WithWriteQueueSize(1)))
+	p.Start(nil)
+	defer p.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errC := make(chan error, 1)
+	go func() {
+		_, err := p.Do(ctx, []byte("hello"))
+		errC <- err
+	}()
+	for p.Statistics().OutputCount == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// the remote is not reading, so the high priority queue is full.
+	for p.TryOutputPriorityMP(msgpump.PriorityHigh, msgpump.MPMessage{[]byte("N\nfill")}) {
+	}
+	cancel()
+	if err := <-errC; err != context.Canceled {
+		t.Fatal("do", err)
+	}
+
+	c2.SetReadDeadline(time.Now().Add(1 * time.Second))
+	rw := msgpump.NetconnMRW(c2)
+	for {
+		m, err := rw.ReadMessage()
+		if err != nil {
+			t.Fatal("cancellation lost", err)
+		}
+		if strings.HasPrefix(string(m), "C,") {
+			break
+		}
+	}
+}
+
+func TestPeerDeadline(t *testing.T) {
+	deadlineC := make(chan time.Duration, 1)
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			deadlineC <- 0
+		} else {
+			deadlineC <- time.Until(deadline)
+		}
+		w(ctx, r)
+	}}
+	p1, p2 := startPeers(echoHandler{}, h)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	p1.Do(context.Background(), []byte("hello"))
+	if d := <-deadlineC; d != 0 {
+		t.Fatal("no deadline", d)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	p1.Do(ctx, []byte("hello"))
+	if d := <-deadlineC; d <= 0 || d > 1*time.Second {
+		t.Fatal("deadline", d)
+	}
+}
+
+func TestPeerDeadlineExpiredInQueue(t *testing.T) {
+	startC := make(chan struct{}, 1)
+	releaseC := make(chan struct{})
+	doneC := make(chan struct{}, 2)
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		startC <- struct{}{}
+		<-releaseC
+		w(ctx, r)
+		doneC <- struct{}{}
+	}}
+	wp := NewWorkerPool(1, time.Second, nil)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	p := NewPeerWithOptions(msgpump.NetconnMRW(c2), wp.Handler(h, 0, OverloadBlock))
+	p.Start(nil)
+	defer p.Stop()
+	go func() {
+		rw := msgpump.NetconnMRW(c1)
+		for {
+			if _, err := rw.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the remote never cancels, the second one expires in the queue.
+	rw := msgpump.NetconnMRW(c1)
+	rw.WriteMessage([]byte("R,1,20\nhello"))
+	<-startC
+	rw.WriteMessage([]byte("R,2,20\nhello"))
+	time.Sleep(50 * time.Millisecond)
+	close(releaseC)
+	<-doneC
+
+	for i := 0; ; i++ {
+		p.locker.Lock()
+		n := len(p.reqs)
+		p.locker.Unlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("requests leaked", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPeerDoStream(t *testing.T) {
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		for i := 0; i < 3; i++ {
+			w.Send(ctx, r)
+		}
+		w(ctx, []byte("end"))
+	}}
+	p1, p2 := startPeers(echoHandler{}, h)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	s, err := p1.DoStream(context.Background(), []byte("chunk"))
+	if err != nil {
+		t.Fatal("do stream", err)
+	}
+	defer s.Close()
+
+	var chunks []string
+	for {
+		chunk, err := s.Recv(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("recv", err)
+		}
+		chunks = append(chunks, string(chunk))
+	}
+	if strings.Join(chunks, ",") != "chunk,chunk,chunk,end" {
+		t.Fatal("stream chunks", chunks)
+	}
+
+	resp, err := p1.Do(context.Background(), []byte("chunk"))
+	if err != nil || string(resp) != "end" {
+		t.Fatal("do", string(resp), err)
+	}
+}
+
+func TestPeerDoStreamCancel(t *testing.T) {
+	cancelledC := make(chan struct{})
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		for w.Send(ctx, r) == nil {
+		}
+		close(cancelledC)
+	}}
+	p1, p2 := startPeers(echoHandler{}, h)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := p1.DoStream(ctx, []byte("chunk"))
+	if err != nil {
+		t.Fatal("do stream", err)
+	}
+	if _, err := s.Recv(context.Background()); err != nil {
+		t.Fatal("recv", err)
+	}
+	cancel()
+
+	select {
+	case <-cancelledC:
+	case <-time.After(1 * time.Second):
+		t.Fatal("request not cancelled")
+	}
+	for {
+		_, err := s.Recv(context.Background())
+		if err == context.Canceled {
+			break
+		}
+		if err != nil {
+			t.Fatal("recv after cancel", err)
+		}
+	}
+
+	p1.locker.Lock()
+	n := len(p1.resps)
+	p1.locker.Unlock()
+	if n != 0 {
+		t.Fatal("call leaked", n)
+	}
+}
+
+func TestPeerStream(t *testing.T) {
+	p1, p2 := startPeers(echoHandler{}, echoHandler{})
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx := context.Background()
+
+	// echo server
+	go func() {
+		for {
+			s, err := p2.AcceptStream(ctx)
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					m, err := s.Recv(ctx)
+					if err == io.EOF {
+						s.Close()
+						return
+					}
+					if err != nil {
+						return
+					}
+					if string(m) == "abort" {
+						s.CloseWithError(500, "aborted")
+						return
+					}
+					s.Send(ctx, m)
+				}
+			}()
+		}
+	}()
+
+	s1, _ := p1.OpenStream(ctx)
+	s2, _ := p1.OpenStream(ctx)
+	for i := 0; i < 3; i++ {
+		s1.Send(ctx, []byte("s1"))
+		s2.Send(ctx, []byte("s2"))
+	}
+	s1.Close()
+	s2.Send(ctx, []byte("abort"))
+
+	for i := 0; i < 3; i++ {
+		m, err := s1.Recv(ctx)
+		if err != nil || string(m) != "s1" {
+			t.Fatal("stream recv", string(m), err)
+		}
+		m, err = s2.Recv(ctx)
+		if err != nil || string(m) != "s2" {
+			t.Fatal("stream recv", string(m), err)
+		}
+	}
+
+	if _, err := s1.Recv(ctx); err != io.EOF {
+		t.Fatal("stream close", err)
+	}
+	if err := s1.Send(ctx, []byte("s1")); err != ErrStreamClosed {
+		t.Fatal("stream send after close", err)
+	}
+
+	_, err := s2.Recv(ctx)
+	if re, ok := err.(*RemoteError); !ok || re.Code != 500 {
+		t.Fatal("stream close with error", err)
+	}
+
+	p1.locker.Lock()
+	n := len(p1.streams)
+	p1.locker.Unlock()
+	if n != 0 {
+		t.Fatal("streams leak", n)
+	}
+}
+
+func TestPeerStreamFlowControl(t *testing.T) {
+	p1, p2 := startPeers(echoHandler{}, echoHandler{})
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx := context.Background()
+
+	s1, _ := p1.OpenStream(ctx)
+	s2, _ := p2.AcceptStream(ctx)
+
+	const size = 1024
+	const count = 2 * InitialStreamWindow / size
+	sentC := make(chan int, 1)
+	go func() {
+		n := 0
+		for ; n < count; n++ {
+			if err := s1.Send(ctx, make([]byte, size)); err != nil {
+				break
+			}
+		}
+		sentC <- n
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	select {
+	case <-sentC:
+		t.Fatal("flow control window")
+	default:
+	}
+
+	// the others are not blocked by the slow stream.
+	resp, err := p1.Do(ctx, []byte("hello"))
+	if err != nil || string(resp) != "hello" {
+		t.Fatal("do", string(resp), err)
+	}
+
+	for i := 0; i < count; i++ {
+		if _, err := s2.Recv(ctx); err != nil {
+			t.Fatal("stream recv", err)
+		}
+	}
+	if n := <-sentC; n != count {
+		t.Fatal("stream send", n)
+	}
+}
+
+func TestPeerStreamWindowExceeded(t *testing.T) {
+	errC := make(chan *ProtocolError, 1)
+	onError := func(err *ProtocolError) {
+		errC <- err
+	}
+	p, rw := startRaw(echoHandler{}, WithProtocolErrorPolicy(DropProtocolError, onError))
+	defer p.Stop()
+
+	// the second message is sent without credits.
+	body := make([]byte, InitialStreamWindow)
+	rw.WriteMessage([]byte("B,1\n"))
+	rw.WriteMessage(append([]byte("D,1,o\n"), body...))
+	rw.WriteMessage(append([]byte("D,1,o\n"), body...))
+
+	if err := <-errC; err.Reason != "flow control window exceeded" {
+		t.Fatal("protocol error", err)
+	}
+	m, err := rw.ReadMessage()
+	if err != nil || string(m) != "F,1,a\n-6,flow control window exceeded" {
+		t.Fatal("stream reset", string(m), err)
+	}
+}
+
+func TestPeerSlowHandler(t *testing.T) {
+	startC := make(chan struct{})
+	cancelledC := make(chan struct{})
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		close(startC)
+		<-ctx.Done()
+		close(cancelledC)
+	}}
+	p1, p2 := startPeers(echoHandler{}, h)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-startC
+		cancel()
+	}()
+	if _, err := p1.Do(ctx, []byte("hello")); err != context.Canceled {
+		t.Fatal("do", err)
+	}
+
+	// the cancellation is read while the handler is blocking.
+	select {
+	case <-cancelledC:
+	case <-time.After(1 * time.Second):
+		t.Fatal("handler not cancelled")
+	}
+}
+
+func TestPeerServeMux(t *testing.T) {
+	notifyC := make(chan string, 1)
+	mux := NewServeMux()
+	mux.Handle("user.get", func(ctx context.Context, r Request, w ResponseWriter) {
+		w(ctx, append([]byte(Method(ctx)+":"), r...))
+	})
+	mux.HandleNotify("event", func(ctx context.Context, n Notify) {
+		notifyC <- Method(ctx) + ":" + string(n)
+	})
+	p1, p2 := startPeers(echoHandler{}, mux)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx := context.Background()
+
+	resp, err := p1.Do(WithMethod(ctx, "user.get"), []byte("hello"))
+	if err != nil || string(resp) != "user.get:hello" {
+		t.Fatal("do", string(resp), err)
+	}
+
+	_, err = p1.Do(WithMethod(ctx, "user.put"), []byte("hello"))
+	if re, ok := err.(*RemoteError); !ok || re.Code != CodeMethodNotFound {
+		t.Fatal("method not found", err)
+	}
+
+	_, err = p1.Do(WithMethod(ctx, "user,get"), []byte("hello"))
+	if err != ErrInvalidMethod {
+		t.Fatal("invalid method", err)
+	}
+
+	p1.Notify(WithMethod(ctx, "event"), []byte("hello"))
+	select {
+	case n := <-notifyC:
+		if n != "event:hello" {
+			t.Fatal("notify", n)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("notify timeout")
+	}
+}
+
+type point struct {
+	X, Y int
+}
+
+func TestPeerCall(t *testing.T) {
+	notifyC := make(chan point, 1)
+	mux := NewServeMux()
+	HandleCall(mux, "point.add", func(ctx context.Context, req [2]point) (point, error) {
+		if req[0].X < 0 {
+			return point{}, &RemoteError{Code: 400, Message: "negative"}
+		}
+		return point{req[0].X + req[1].X, req[0].Y + req[1].Y}, nil
+	})
+	HandlePost(mux, "point.move", func(ctx context.Context, n point) {
+		notifyC <- n
+	})
+	p1, p2 := startPeers(echoHandler{}, mux)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx := context.Background()
+
+	resp, err := Call[[2]point, point](ctx, p1, "point.add", [2]point{{1, 2}, {3, 4}})
+	if err != nil || resp != (point{4, 6}) {
+		t.Fatal("call", resp, err)
+	}
+
+	_, err = Call[[2]point, point](ctx, p1, "point.add", [2]point{{-1, 2}, {3, 4}})
+	if re, ok := err.(*RemoteError); !ok || re.Code != 400 {
+		t.Fatal("call error", err)
+	}
+
+	_, err = Call[string, point](ctx, p1, "point.add", "bad")
+	if re, ok := err.(*RemoteError); !ok || re.Code != CodeInvalidRequest {
+		t.Fatal("call invalid request", err)
+	}
+
+	Post(ctx, p1, "point.move", point{5, 6})
+	select {
+	case n := <-notifyC:
+		if n != (point{5, 6}) {
+			t.Fatal("post", n)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("post timeout")
+	}
+}
+
+func TestPeerMetadata(t *testing.T) {
+	mdC := make(chan Metadata, 1)
+	h := funcHandler{
+		process: func(ctx context.Context, r Request, w ResponseWriter) {
+			mdC <- MetadataFrom(ctx)
+			w(ctx, []byte(Method(ctx)))
+		},
+		notify: func(ctx context.Context, n Notify) {
+			mdC <- MetadataFrom(ctx)
+		},
+	}
+	p1, p2 := startPeers(echoHandler{}, h)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	md := Metadata{"trace-id": "a,b&c=d", "tenant": "t1\n"}
+	ctx := WithMetadata(context.Background(), md)
+
+	resp, err := p1.Do(ctx, []byte("hello"))
+	if err != nil || string(resp) != "" {
+		t.Fatal("do", string(resp), err)
+	}
+	if got := <-mdC; len(got) != 2 || got["trace-id"] != md["trace-id"] || got["tenant"] != md["tenant"] {
+		t.Fatal("request metadata", got)
+	}
+
+	resp, err = p1.Do(WithMethod(ctx, "user.get"), []byte("hello"))
+	if err != nil || string(resp) != "user.get" {
+		t.Fatal("do", string(resp), err)
+	}
+	if got := <-mdC; got["tenant"] != md["tenant"] {
+		t.Fatal("request metadata", got)
+	}
+
+	p1.Notify(ctx, []byte("hello"))
+	select {
+	case got := <-mdC:
+		if got["trace-id"] != md["trace-id"] {
+			t.Fatal("notify metadata", got)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("notify timeout")
+	}
+
+	p1.Do(context.Background(), []byte("hello"))
+	if got := <-mdC; got != nil {
+		t.Fatal("no metadata", got)
+	}
+
+	big := Metadata{"token": strings.Repeat("x", MaxHeaderLen)}
+	if _, err := p1.Do(WithMetadata(ctx, big), []byte("hello")); err != ErrHeaderTooLarge {
+		t.Fatal("header too large", err)
+	}
+}
+
+func TestPeerInterceptors(t *testing.T) {
+	var trace []string
+	tracer := func(name string) ClientInterceptor {
+		return func(ctx context.Context, r Request, invoker Invoker) (Response, error) {
+			trace = append(trace, name)
+			return invoker(ctx, r)
+		}
+	}
+	recoverer := func(ctx context.Context, r Request, w ResponseWriter, next HandlerFunc) {
+		defer func() {
+			if v := recover(); v != nil {
+				w.WriteError(ctx, CodeInternalError, "panic")
+			}
+		}()
+		next(ctx, r, w)
+	}
+	upper := func(ctx context.Context, r Request, w ResponseWriter, next HandlerFunc) {
+		next(ctx, []byte(strings.ToUpper(string(r))), w)
+	}
+	notifyC := make(chan string, 1)
+	tagger := func(ctx context.Context, n Notify, next NotifyFunc) {
+		next(ctx, append([]byte("tag:"), n...))
+	}
+
+	h := funcHandler{
+		process: func(ctx context.Context, r Request, w ResponseWriter) {
+			if string(r) == "PANIC" {
+				panic("boom")
+			}
+			w(ctx, r)
+		},
+		notify: func(ctx context.Context, n Notify) {
+			notifyC <- string(n)
+		},
+	}
+	c1, c2 := net.Pipe()
+	p1 := NewPeerWithOptions(msgpump.NetconnMRW(c1), echoHandler{},
+		WithClientInterceptors(tracer("a"), tracer("b")))
+	p2 := NewPeerWithOptions(msgpump.NetconnMRW(c2), h,
+		WithServerInterceptors([]ServerInterceptor{recoverer, upper}, []NotifyInterceptor{tagger}))
+	p1.Start(nil)
+	p2.Start(nil)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx := context.Background()
+
+	resp, err := p1.Do(ctx, []byte("hello"))
+	if err != nil || string(resp) != "HELLO" {
+		t.Fatal("do", string(resp), err)
+	}
+	if strings.Join(trace, ",") != "a,b" {
+		t.Fatal("client interceptors", trace)
+	}
+
+	_, err = p1.Do(ctx, []byte("panic"))
+	if re, ok := err.(*RemoteError); !ok || re.Code != CodeInternalError {
+		t.Fatal("recover interceptor", err)
+	}
+
+	p1.Notify(ctx, []byte("hello"))
+	select {
+	case n := <-notifyC:
+		if n != "tag:hello" {
+			t.Fatal("notify interceptor", n)
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("notify timeout")
+	}
+}
+
+func TestHeaderFormats(t *testing.T) {
+	frames := []frame{
+		{t: 'R', id: 1},
+		{t: 'Q', id: 0x1234, n: 500, method: "user.get", md: Metadata{"k": "v,&="}},
+		{t: 'N'},
+		{t: 'N', method: "event", md: Metadata{"k": "v"}},
+		{t: 'P', id: 1 << 60},
+		{t: 'D', id: 7, side: 'o'},
+		{t: 'W', id: 7, side: 'q', n: 65536},
+	}
+	for _, bin := range []bool{false, true} {
+		for _, f := range frames {
+			m := append(appendHeader(nil, &f, bin), "body"...)
+
+			var g frame
+			body, ok := parseHeader(m, &g)
+			if !ok || string(body) != "body" {
+				t.Fatal("parse header", bin, string(m))
+			}
+			if g.t != f.t || g.id != f.id || g.side != f.side || g.n != f.n ||
+				g.method != f.method || len(g.md) != len(f.md) || g.md["k"] != f.md["k"] {
+				t.Fatal("header", bin, f, g)
+			}
+		}
+	}
+
+	for _, m := range []string{"", "R", "R\n", "R,\n", "R,x\n", "D,1\n", "W,1,q\n", "\x80"} {
+		var f frame
+		if _, ok := parseHeader([]byte(m), &f); ok {
+			t.Fatal("parse malformed header", m)
+		}
+	}
+}
+
+func TestPeerBinaryHeader(t *testing.T) {
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		w.Send(ctx, []byte(Method(ctx)))
+		w(ctx, []byte(MetadataFrom(ctx)["k"]))
+	}}
+	c1, c2 := net.Pipe()
+	p1 := NewPeerWithOptions(msgpump.NetconnMRW(c1), echoHandler{}, WithBinaryHeader(true))
+	p2 := NewPeerWithOptions(msgpump.NetconnMRW(c2), h)
+	p1.Start(nil)
+	p2.Start(nil)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	ctx = WithMetadata(WithMethod(ctx, "user.get"), Metadata{"k": "v"})
+
+	s, err := p1.DoStream(ctx, []byte("hello"))
+	if err != nil {
+		t.Fatal("do stream", err)
+	}
+	defer s.Close()
+	for _, want := range []string{"user.get", "v"} {
+		chunk, err := s.Recv(ctx)
+		if err != nil || string(chunk) != want {
+			t.Fatal("recv", string(chunk), err)
+		}
+	}
+
+	resp, err := p2.Do(ctx, []byte("hello"))
+	if err != nil || string(resp) != "hello" {
+		t.Fatal("do", string(resp), err)
+	}
+}
+
+func TestPeerHandshake(t *testing.T) {
+	c1, c2 := net.Pipe()
+	p1 := NewPeerWithOptions(msgpump.NetconnMRW(c1), echoHandler{},
+		WithBinaryHeader(true), WithHandshake(1*time.Second, Metadata{"app": "a1"}, nil))
+	p2 := NewPeerWithOptions(msgpump.NetconnMRW(c2), echoHandler{},
+		WithBinaryHeader(true), WithHeartbeat(1*time.Second, 3))
+	p1.Start(nil)
+	p2.Start(nil)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx := context.Background()
+
+	remote, err := p1.WaitHandshake(ctx)
+	if err != nil || remote.Version != ProtocolVersion ||
+		!remote.HasFeature(FeatureBinaryHeader) || !remote.HasFeature(FeatureHeartbeat) {
+		t.Fatal("handshake", remote, err)
+	}
+	remote, err = p2.WaitHandshake(ctx)
+	if err != nil || remote.Metadata["app"] != "a1" || remote.HasFeature(FeatureHeartbeat) {
+		t.Fatal("handshake", remote, err)
+	}
+	if p1.binary != 1 {
+		t.Fatal("binary header not negotiated")
+	}
+
+	resp, err := p1.Do(ctx, []byte("hello"))
+	if err != nil || string(resp) != "hello" {
+		t.Fatal("do", string(resp), err)
+	}
+}
+
+func TestPeerHandshakeFail(t *testing.T) {
+	errRejected := errors.New("rejected")
+	c1, c2 := net.Pipe()
+	p1 := NewPeerWithOptions(msgpump.NetconnMRW(c1), echoHandler{},
+		WithHandshake(1*time.Second, nil, func(remote *Hello) error {
+			return errRejected
+		}))
+	p2 := NewPeerWithOptions(msgpump.NetconnMRW(c2), echoHandler{})
+	p1.Start(nil)
+	p2.Start(nil)
+	defer p1.Stop()
+	defer p2.Stop()
+
+	if _, err := p1.WaitHandshake(context.Background()); err != errRejected {
+		t.Fatal("handshake rejected", err)
+	}
+
+	p := startSilent(echoHandler{}, WithHandshake(10*time.Millisecond, nil, nil))
+	if _, err := p.WaitHandshake(context.Background()); err != ErrHandshakeTimeout {
+		t.Fatal("handshake timeout", err)
+	}
+
+	p = startSilent(echoHandler{})
+	p.onHello([]byte("H,0"), encodeHello(&Hello{Version: 99, MinVersion: 99}))
+	if _, err := p.WaitHandshake(context.Background()); err != ErrIncompatibleProtocol {
+		t.Fatal("incompatible protocol", err)
+	}
+}
+
+// startRaw starts a peer whose remote side is a raw MessageReadWriter.
+func startRaw(h Handler, opts ...Option) (*Peer, msgpump.MessageReadWriter) {
+	c1, c2 := net.Pipe()
+	p := NewPeerWithOptions(msgpump.NetconnMRW(c1), h, opts...)
+	p.Start(nil)
+	return p, msgpump.NetconnMRW(c2)
+}
+
+func TestPeerProtocolError(t *testing.T) {
+	errC := make(chan *ProtocolError, 1)
+	onError := func(err *ProtocolError) {
+		errC <- err
+	}
+
+	p, rw := startRaw(echoHandler{}, WithProtocolErrorPolicy(DropProtocolError, onError))
+	rw.WriteMessage([]byte("R"))
+	if err := <-errC; err.Remote || string(err.Header) != "R" {
+		t.Fatal("malformed header", err)
+	}
+	rw.WriteMessage([]byte("R,1\nhello"))
+	if m, err := rw.ReadMessage(); err != nil || string(m) != "P,1\nhello" {
+		t.Fatal("response after drop", string(m), err)
+	}
+	p.Stop()
+
+	p, rw = startRaw(echoHandler{}, WithProtocolErrorPolicy(ReplyProtocolError, onError))
+	rw.WriteMessage([]byte("Z,1\n"))
+	if m, err := rw.ReadMessage(); err != nil || string(m) != "X,0\nunknown frame type" {
+		t.Fatal("protocol error reply", string(m), err)
+	}
+	<-errC
+	rw.WriteMessage([]byte("X,0\nbad"))
+	if err := <-errC; !err.Remote || err.Reason != "bad" {
+		t.Fatal("remote protocol error", err)
+	}
+	rw.WriteMessage([]byte("H,0\ngarbage"))
+	if err := <-errC; err.Remote || err.Reason != "malformed hello" {
+		t.Fatal("malformed hello", err)
+	}
+	if p.Stopped() {
+		t.Fatal("stop on malformed hello")
+	}
+	p.Stop()
+
+	p, rw = startRaw(echoHandler{}, WithProtocolErrorPolicy(StopOnProtocolError, nil))
+	rw.WriteMessage([]byte("R,x\n"))
+	select {
+	case <-p.StopD():
+	case <-time.After(1 * time.Second):
+		t.Fatal("stop on protocol error")
+	}
+	if err := p.Error(); !errors.Is(err, ErrProtocol) {
+		t.Fatal("protocol error", err)
+	}
+}
+
+func TestBoundedParallelHandler(t *testing.T) {
+	var locker sync.Mutex
+	running, maxRunning := 0, 0
+	releaseC := make(chan struct{})
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		locker.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		locker.Unlock()
+
+		<-releaseC
+
+		locker.Lock()
+		running--
+		locker.Unlock()
+		w(ctx, r)
+	}}
+
+	p1, p2 := startPeers(echoHandler{},
+		BoundedParallelHandler(h, time.Second, nil, 2, OverloadReject))
+	defer p1.Stop()
+	defer p2.Stop()
+
+	ctx := context.Background()
+	errC := make(chan error, 3)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := p1.Do(ctx, []byte("hello"))
+			errC <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	_, err := p1.Do(ctx, []byte("hello"))
+	if re, ok := err.(*RemoteError); !ok || re.Code != CodeOverloaded {
+		t.Fatal("overloaded", err)
+	}
+	close(releaseC)
+	for i := 0; i < 2; i++ {
+		if err := <-errC; err != nil {
+			t.Fatal("do", err)
+		}
+	}
+
+	releaseC = make(chan struct{})
+	p3, p4 := startPeers(echoHandler{},
+		BoundedParallelHandler(h, time.Second, nil, 2, OverloadBlock))
+	defer p3.Stop()
+	defer p4.Stop()
+
+	const count = 6
+	errC = make(chan error, count)
+	for i := 0; i < count; i++ {
+		go func() {
+			_, err := p3.Do(ctx, []byte("hello"))
+			errC <- err
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(releaseC)
+	for i := 0; i < count; i++ {
+		if err := <-errC; err != nil {
+			t.Fatal("do", err)
+		}
+	}
+	if maxRunning != 2 {
+		t.Fatal("max workers", maxRunning)
+	}
+}
+
+func TestWorkerPool(t *testing.T) {
+	startC := make(chan string, 16)
+	releaseC := make(chan struct{})
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		startC <- string(r)
+		if string(r) == "block" {
+			<-releaseC
+		}
+		w(ctx, r)
+	}}
+	respC := make(chan string, 16)
+	w := ResponseWriter(func(ctx context.Context, resp Response) error {
+		respC <- string(resp)
+		return nil
+	})
+	ctx := context.Background()
+
+	// there are maxWorkers workers at most.
+	wp := NewWorkerPool(2, time.Minute, nil)
+	ph := wp.Handler(h, 0, OverloadBlock)
+	for i := 0; i < 3; i++ {
+		ph.Process(ctx, []byte("block"), w)
+	}
+	<-startC
+	<-startC
+	select {
+	case <-startC:
+		t.Fatal("max workers")
+	default:
+	}
+	releaseC <- struct{}{}
+	<-startC
+	close(releaseC)
+	for i := 0; i < 3; i++ {
+		<-respC
+	}
+
+	// occupy the only worker, then queue the requests of the two handlers.
+	releaseC = make(chan struct{})
+	wp = NewWorkerPool(1, time.Minute, nil)
+	h1 := wp.Handler(h, 4, OverloadBlock)
+	h2 := wp.Handler(h, 4, OverloadReject)
+	h1.Process(ctx, []byte("block"), w)
+	<-startC
+	for i := 0; i < 4; i++ {
+		h1.Process(ctx, []byte("h1"), w)
+		h2.Process(ctx, []byte("h2"), w)
+	}
+
+	h2.Process(ctx, []byte("h2"), w)
+	if resp := <-respC; resp != string(encodeError(CodeOverloaded, "overloaded")) {
+		t.Fatal("overloaded", resp)
+	}
+
+	blockedC := make(chan struct{})
+	go func() {
+		h1.Process(ctx, []byte("h1x"), w)
+		close(blockedC)
+	}()
+	select {
+	case <-blockedC:
+		t.Fatal("overload block")
+	default:
+	}
+
+	close(releaseC)
+	<-blockedC
+
+	// the handlers are served in turn.
+	var order []string
+	for i := 0; i < 9; i++ {
+		order = append(order, <-startC)
+	}
+	if s := strings.Join(order, ","); s != "h1,h2,h1,h2,h1,h2,h1,h2,h1x" {
+		t.Fatal("fairness", s)
+	}
+	for i := 0; i < 10; i++ {
+		<-respC
+	}
+}
+
+func TestKeyedParallelHandler(t *testing.T) {
+	var locker sync.Mutex
+	got := make(map[string][]string)
+	doneC := make(chan struct{}, 16)
+	releaseC := make(chan struct{})
+	h := funcHandler{
+		process: func(ctx context.Context, r Request, w ResponseWriter) {
+			if string(r) == "a:block" {
+				<-releaseC
+			}
+			w(ctx, r)
+		},
+		notify: func(ctx context.Context, n Notify) {
+			k, v, _ := strings.Cut(string(n), ":")
+			if k == "a" && v == "0" {
+				<-releaseC
+			}
+			locker.Lock()
+			got[k] = append(got[k], v)
+			locker.Unlock()
+			doneC <- struct{}{}
+		},
+	}
+	key := func(ctx context.Context, m msgpump.Message) string {
+		k, _, _ := strings.Cut(string(m), ":")
+		return k
+	}
+
+	kh := KeyedParallelHandler(h, key, time.Minute, nil, 0, OverloadBlock)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		kh.OnNotify(ctx, []byte("a:"+strconv.Itoa(i)))
+		kh.OnNotify(ctx, []byte("b:"+strconv.Itoa(i)))
+	}
+
+	// "b" is not blocked by "a".
+	for i := 0; i < 3; i++ {
+		<-doneC
+	}
+	locker.Lock()
+	if len(got["a"]) != 0 || strings.Join(got["b"], ",") != "0,1,2" {
+		t.Fatal("keyed parallel", got)
+	}
+	locker.Unlock()
+
+	close(releaseC)
+	for i := 0; i < 3; i++ {
+		<-doneC
+	}
+	locker.Lock()
+	if strings.Join(got["a"], ",") != "0,1,2" {
+		t.Fatal("keyed order", got)
+	}
+	locker.Unlock()
+
+	// the pending calls are bounded.
+	respC := make(chan string, 16)
+	w := ResponseWriter(func(ctx context.Context, resp Response) error {
+		respC <- string(resp)
+		return nil
+	})
+	releaseC = make(chan struct{})
+	kh = KeyedParallelHandler(h, key, time.Minute, nil, 3, OverloadReject)
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	kh.Process(ctx, []byte("a:block"), w)
+	kh.Process(cctx, []byte("a:cancelled"), w)
+	kh.Process(ctx, []byte("a:x"), w)
+	kh.Process(ctx, []byte("b:y"), w)
+	if resp := <-respC; resp != string(encodeError(CodeOverloaded, "overloaded")) {
+		t.Fatal("overloaded", resp)
+	}
+
+	// the cancelled one is dropped without reply.
+	close(releaseC)
+	var resps []string
+	for i := 0; i < 2; i++ {
+		resps = append(resps, <-respC)
+	}
+	if s := strings.Join(resps, "|"); s != "a:block|a:x" {
+		t.Fatal("keyed bounded", s)
+	}
+}
+
+func TestPeerLogger(t *testing.T) {
+	logC := make(chan string, 16)
+	logger := slog.New(slog.NewTextHandler(writerFunc(func(b []byte) (int, error) {
+		logC <- string(b)
+		return len(b), nil
+	}), nil))
+
+	p, rw := startRaw(echoHandler{},
+		WithLogger(logger), WithProtocolErrorPolicy(StopOnProtocolError, nil))
+	rw.WriteMessage([]byte("Z,1\n"))
+
+	select {
+	case <-p.StopD():
+	case <-time.After(1 * time.Second):
+		t.Fatal("stop on protocol error")
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(logC)
+
+	var logs []string
+	for l := range logC {
+		logs = append(logs, l)
+	}
+	s := strings.Join(logs, "")
+	for _, want := range []string{
+		`msg="peer protocol error" local=pipe remote=pipe reason="unknown frame type"`,
+		`msg="peer stopping"`,
+		`msg="pump stopped"`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Fatal("log", want, s)
+		}
+	}
+}
+
+func TestPeerHandlerPanic(t *testing.T) {
+	panicC := make(chan interface{}, 1)
+	h := funcHandler{process: func(ctx context.Context, r Request, w ResponseWriter) {
+		panic("boom")
+	}}
+	p, rw := startRaw(h, WithPumpOptions(msgpump.WithPanicLogFunc(func(v interface{}) {
+		panicC <- v
+	})))
+	rw.WriteMessage([]byte("R,1\nhello"))
+
+	select {
+	case <-p.StopD():
+	case <-time.After(1 * time.Second):
+		t.Fatal("panic stop")
+	}
+	if v := <-panicC; v != "boom" {
+		t.Fatal("panic log", v)
+	}
+	if err := p.Error(); err == nil || err.Error() != "unknown panic" {
+		t.Fatal("panic error", err)
+	}
+}
+
+func TestPeerHandlerBacklog(t *testing.T) {
+	releaseC := make(chan struct{})
+	h := funcHandler{notify: func(ctx context.Context, n Notify) {
+		<-releaseC
+	}}
+	p, rw := startRaw(h, WithHandlerBacklog(1))
+	defer p.Stop()
+
+	// one in the handler, one in the backlog, and one stalls the reading.
+	go func() {
+		for i := 0; i < 3; i++ {
+			rw.WriteMessage([]byte("N\nhello"))
+		}
+		rw.WriteMessage([]byte("I,1\n"))
+	}()
+
+	mC := make(chan []byte, 1)
+	go func() {
+		m, _ := rw.ReadMessage()
+		mC <- m
+	}()
+	select {
+	case m := <-mC:
+		t.Fatal("read after backlog full", string(m))
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(releaseC)
+	select {
+	case m := <-mC:
+		if !strings.HasPrefix(string(m), "O,1") {
+			t.Fatal("pong", string(m))
+		}
+	case <-time.After(1 * time.Second):
+		t.Fatal("read after backlog drained")
+	}
+}
+
+func TestPeerWorkerPanicLogger(t *testing.T) {
+	logC := make(chan string, 16)
+	logger := slog.New(slog.NewTextHandler(writerFunc(func(b []byte) (int, error) {
+		logC <- string(b)
+		return len(b), nil
+	}), nil))
+
+	h := funcHandler{notify: func(ctx context.Context, n Notify) {
+		panic("boom")
+	}}
+	handlers := []Handler{
+		ParallelHandler(h, time.Second, nil),
+		NewWorkerPool(1, time.Second, nil).Handler(h, 0, OverloadBlock),
+		KeyedParallelHandler(h, func(context.Context, msgpump.Message) string { return "" },
+			time.Second, nil, 0, OverloadBlock),
+	}
+	for _, h := range handlers {
+		p, rw := startRaw(h, WithLogger(logger))
+		rw.WriteMessage([]byte("N\nhello"))
+
+	wait:
+		for {
+			select {
+			case l := <-logC:
+				if strings.Contains(l, `msg="worker panic" local=pipe remote=pipe panic=boom`) {
+					break wait
+				}
+			case <-time.After(1 * time.Second):
+				t.Fatal("worker panic log")
+			}
+		}
+		p.Stop()
+	}
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
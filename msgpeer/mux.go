@@ -0,0 +1,80 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"sync"
+)
+
+// The HandlerFunc type is an adapter to allow the use of ordinary functions
+// as request processors, see ServeMux.Handle.
+type HandlerFunc func(ctx context.Context, r Request, w ResponseWriter)
+
+// The NotifyFunc type is an adapter to allow the use of ordinary functions
+// as notify processors, see ServeMux.HandleNotify.
+type NotifyFunc func(ctx context.Context, n Notify)
+
+// ServeMux is a Handler which dispatches the requests and notifies by their
+// method names, see WithMethod.
+//
+// The request of unknown method will be replied an error response with
+// CodeMethodNotFound, the notify of unknown method will be dropped.
+//
+// ServeMux supports concurrently access.
+type ServeMux struct {
+	locker   sync.RWMutex
+	handlers map[string]HandlerFunc
+	notifies map[string]NotifyFunc
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{
+		handlers: make(map[string]HandlerFunc),
+		notifies: make(map[string]NotifyFunc),
+	}
+}
+
+// Handle registers the request processor for the method, the previous one
+// will be replaced.
+func (mux *ServeMux) Handle(method string, f HandlerFunc) {
+	mux.locker.Lock()
+	mux.handlers[method] = f
+	mux.locker.Unlock()
+}
+
+// HandleNotify registers the notify processor for the method, the previous
+// one will be replaced.
+func (mux *ServeMux) HandleNotify(method string, f NotifyFunc) {
+	mux.locker.Lock()
+	mux.notifies[method] = f
+	mux.locker.Unlock()
+}
+
+// Process implements the Handler interface.
+func (mux *ServeMux) Process(ctx context.Context, r Request, w ResponseWriter) {
+	method := Method(ctx)
+	mux.locker.RLock()
+	f := mux.handlers[method]
+	mux.locker.RUnlock()
+
+	if f == nil {
+		w.WriteError(ctx, CodeMethodNotFound, "method not found: "+method)
+		return
+	}
+	f(ctx, r, w)
+}
+
+// OnNotify implements the Handler interface.
+func (mux *ServeMux) OnNotify(ctx context.Context, n Notify) {
+	mux.locker.RLock()
+	f := mux.notifies[Method(ctx)]
+	mux.locker.RUnlock()
+
+	if f != nil {
+		f(ctx, n)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/someonegg/msgpump/v2"
+)
+
+type options struct {
+	pumpOpts []msgpump.Option
+
+	hbInterval time.Duration
+	hbMaxMiss  int
+
+	streamWindow int
+
+	codec        Codec
+	binaryHeader bool
+
+	handlerBacklog int
+
+	handshake  bool
+	hsTimeout  time.Duration
+	hsMetadata Metadata
+	hsCheck    func(remote *Hello) error
+
+	protoPolicy ProtocolErrorPolicy
+	onProtoErr  func(err *ProtocolError)
+
+	clientICs []ClientInterceptor
+	serverICs []ServerInterceptor
+	notifyICs []NotifyInterceptor
+}
+
+// Option configures the peer, see NewPeerWithOptions.
+type Option func(*options)
+
+// WithPumpOptions sets the options of the underlying message-pump.
+func WithPumpOptions(opts ...msgpump.Option) Option {
+	return func(o *options) {
+		o.pumpOpts = append(o.pumpOpts, opts...)
+	}
+}
+
+// WithHeartbeat enables the heartbeat, a ping will be sent every interval
+// if the last one is answered, and the peer will stop with
+// ErrHeartbeatTimeout if a ping is not answered within maxMiss intervals.
+func WithHeartbeat(interval time.Duration, maxMiss int) Option {
+	return func(o *options) {
+		o.hbInterval = interval
+		o.hbMaxMiss = maxMiss
+	}
+}
+
+// WithStreamWindow sets the flow control window (in bytes) for receiving each
+// stream or streaming response, it can not be less than InitialStreamWindow,
+// which is the default.
+func WithStreamWindow(window int) Option {
+	return func(o *options) {
+		o.streamWindow = window
+	}
+}
+
+// WithHandlerBacklog sets the maximum number of requests and notifies
+// waiting for the handler, the peer stops reading messages when exceeded.
+// DefaultHandlerBacklog is used if n is not positive.
+func WithHandlerBacklog(n int) Option {
+	return func(o *options) {
+		o.handlerBacklog = n
+	}
+}
+
+// WithCodec sets the codec of the typed messages, JSONCodec is used by
+// default, see Call and HandleCall.
+func WithCodec(c Codec) Option {
+	return func(o *options) {
+		o.codec = c
+	}
+}
+
+// WithBinaryHeader sets whether to send the messages with the compact binary
+// header instead of the text one, it is disabled by default.
+//
+// The peer can always receive both formats, so the peers can enable it
+// independently. If the handshake is enabled, the binary header is used only
+// after the remote advertises FeatureBinaryHeader, see WithHandshake.
+func WithBinaryHeader(enable bool) Option {
+	return func(o *options) {
+		o.binaryHeader = enable
+	}
+}
+
+// WithHandshake enables the handshake, the hello (see Hello) with the
+// application metadata md will be sent at Start, and the peer will stop if
+// the remote hello is not received within timeout (zero means no timeout),
+// or the protocol versions are incompatible, or check returns an error.
+//
+// The peer always replies the remote hello, even if the handshake is not
+// enabled, see Peer.WaitHandshake.
+func WithHandshake(timeout time.Duration, md Metadata, check func(remote *Hello) error) Option {
+	return func(o *options) {
+		o.handshake = true
+		o.hsTimeout = timeout
+		o.hsMetadata = md
+		o.hsCheck = check
+	}
+}
+
+// WithProtocolErrorPolicy sets how to handle the malformed or unknown frames,
+// DropProtocolError is used by default. The onError callback is optional, it
+// is called for each protocol error, including the ones reported by the
+// remote (see ReplyProtocolError), from the reading loop.
+func WithProtocolErrorPolicy(policy ProtocolErrorPolicy, onError func(err *ProtocolError)) Option {
+	return func(o *options) {
+		o.protoPolicy = policy
+		o.onProtoErr = onError
+	}
+}
+
+// WithClientInterceptors appends the interceptors of Peer.Do, the first one
+// is the outermost.
+func WithClientInterceptors(ics ...ClientInterceptor) Option {
+	return func(o *options) {
+		o.clientICs = append(o.clientICs, ics...)
+	}
+}
+
+// WithServerInterceptors appends the interceptors of the handler, the first
+// one is the outermost, see InterceptHandler.
+//
+// They are called before the handler, so they run serially in the handler
+// goroutine of the peer if the handler is a ParallelHandler, use
+// InterceptHandler inside ParallelHandler instead if it matters.
+func WithServerInterceptors(process []ServerInterceptor, notify []NotifyInterceptor) Option {
+	return func(o *options) {
+		o.serverICs = append(o.serverICs, process...)
+		o.notifyICs = append(o.notifyICs, notify...)
+	}
+}
+
+// WithLogger sets the structured logger of the peer and the underlying
+// message-pump (see msgpump.WithLogger), the peer records the stop reason,
+// the handshake, and the protocol errors. The worker panics of the parallel
+// handlers are written to it too, if their workerPanicLog is nil.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.pumpOpts = append(o.pumpOpts, msgpump.WithLogger(l))
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/someonegg/gox/syncx"
+	"github.com/someonegg/msgpump/v2/internal/worker"
+)
+
+// WorkerPool is a pool of workers shared by many handlers, usually of
+// different peers, see WorkerPool.Handler.
+//
+// The pending messages of each handler are queued separately, and the
+// workers take them from the handlers in turn, so a busy peer can not
+// starve the others.
+//
+// WorkerPool supports concurrently access.
+type WorkerPool struct {
+	max      int
+	g        *worker.Group
+	panicLog func(interface{})
+
+	locker   sync.Mutex
+	draining int            // the workers taking the pending messages
+	active   []*poolHandler // the handlers with pending messages
+}
+
+// NewWorkerPool allocates and returns a new pool, there are maxWorkers
+// workers at most, and a worker will exit after idle for workerIdleTimeout.
+//
+// The workerPanicLog is optional, see ParallelHandler.
+func NewWorkerPool(maxWorkers int, workerIdleTimeout time.Duration,
+	workerPanicLog func(panicV interface{})) *WorkerPool {
+
+	if maxWorkers <= 0 {
+		panic("invalid maxWorkers")
+	}
+
+	return &WorkerPool{
+		max:      maxWorkers,
+		g:        worker.NewGroup(workerIdleTimeout, workerPanicLog, maxWorkers),
+		panicLog: workerPanicLog,
+	}
+}
+
+type poolHandler struct {
+	wp     *WorkerPool
+	h      Handler
+	max    int
+	policy OverloadPolicy
+	space  syncx.Event
+
+	// guarded by wp.locker
+	pending []entry
+	queued  bool // in wp.active
+}
+
+// Handler converts h to parallel mode over the pool, each call will be
+// initiated from a worker goroutine of the pool. The calls whose ctx is done
+// are dropped like ParallelHandler.
+//
+// There are maxPending messages waiting for the workers at most for h, the
+// policy is applied when exceeded. Zero maxPending means unbounded.
+func (wp *WorkerPool) Handler(h Handler, maxPending int, policy OverloadPolicy) Handler {
+	return &poolHandler{
+		wp:     wp,
+		h:      h,
+		max:    maxPending,
+		policy: policy,
+		space:  syncx.NewEvent(),
+	}
+}
+
+func (h *poolHandler) Process(ctx context.Context, r Request, w ResponseWriter) {
+	h.submit(entry{ctx, r, w})
+}
+
+func (h *poolHandler) OnNotify(ctx context.Context, n Notify) {
+	h.submit(entry{ctx, n, nil})
+}
+
+func (h *poolHandler) submit(e entry) {
+	for !h.wp.push(h, e) {
+		if !h.policy.overloaded(e) {
+			return
+		}
+
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-h.space:
+		}
+	}
+}
+
+// push queues the entry of h, and runs a worker to drain the pending
+// messages if needed. It returns false if the pending messages of h exceed.
+func (wp *WorkerPool) push(h *poolHandler, e entry) bool {
+	wp.locker.Lock()
+	if h.max > 0 && len(h.pending) >= h.max {
+		wp.locker.Unlock()
+		return false
+	}
+
+	h.pending = append(h.pending, e)
+	if !h.queued {
+		h.queued = true
+		wp.active = append(wp.active, h)
+	}
+
+	drain := wp.draining < wp.max
+	if drain {
+		wp.draining++
+	}
+	wp.locker.Unlock()
+
+	if drain {
+		// there is a worker idle or returning from drain at least.
+		wp.g.Run(context.Background(), wp.drain)
+	}
+	return true
+}
+
+// pop returns the next entry in turn, the caller should hold the lock.
+func (wp *WorkerPool) pop() (*poolHandler, entry, bool) {
+	if len(wp.active) == 0 {
+		return nil, entry{}, false
+	}
+
+	h := wp.active[0]
+	wp.active[0] = nil
+	wp.active = wp.active[1:]
+
+	e := h.pending[0]
+	h.pending[0] = entry{}
+	h.pending = h.pending[1:]
+	if len(h.pending) > 0 {
+		wp.active = append(wp.active, h)
+	} else {
+		h.queued = false
+	}
+	h.space.Set()
+	return h, e, true
+}
+
+// drain handles the pending messages in turn until none left.
+func (wp *WorkerPool) drain() {
+	for {
+		wp.locker.Lock()
+		h, e, ok := wp.pop()
+		if !ok {
+			wp.draining--
+		}
+		wp.locker.Unlock()
+
+		if !ok {
+			return
+		}
+		if e.ctx.Err() == nil {
+			wp.handle(h.h, e)
+		}
+	}
+}
+
+func (wp *WorkerPool) handle(h Handler, e entry) {
+	defer func() {
+		if v := recover(); v != nil {
+			worker.Recovered(e.ctx, wp.panicLog, v)
+		}
+	}()
+
+	dispatch(h, e)
+}
@@ -0,0 +1,10 @@
+module github.com/someonegg/msgpump/v2/msgpeer/protocodec
+
+go 1.21
+
+require (
+	github.com/someonegg/msgpump/v2 v2.1.0 // the first version with msgpeer.Codec
+	google.golang.org/protobuf v1.33.0
+)
+
+require github.com/someonegg/gox v1.0.5 // indirect
@@ -0,0 +1,54 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package protocodec implements the msgpeer.Codec with protobuf.
+//
+// The typed messages should be the pointers of the generated protobuf
+// messages, like msgpeer.Call[*pb.Req, *pb.Resp].
+package protocodec
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/someonegg/msgpump/v2/msgpeer"
+	"google.golang.org/protobuf/proto"
+)
+
+var ErrNotProtoMessage = errors.New("protocodec: not proto message")
+
+type codec struct{}
+
+// Codec is the msgpeer.Codec using protobuf.
+var Codec msgpeer.Codec = codec{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, ErrNotProtoMessage
+	}
+	return proto.Marshal(m)
+}
+
+// Unmarshal accepts a proto.Message, or a pointer to it which will be
+// allocated if nil.
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Ptr {
+		return ErrNotProtoMessage
+	}
+	e := rv.Elem()
+	if e.IsNil() {
+		e.Set(reflect.New(e.Type().Elem()))
+	}
+	m, ok := e.Interface().(proto.Message)
+	if !ok {
+		return ErrNotProtoMessage
+	}
+	return proto.Unmarshal(data, m)
+}
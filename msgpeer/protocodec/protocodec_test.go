@@ -0,0 +1,31 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protocodec
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodec(t *testing.T) {
+	b, err := Codec.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatal("marshal", err)
+	}
+
+	var m *wrapperspb.StringValue
+	if err := Codec.Unmarshal(b, &m); err != nil || m.GetValue() != "hello" {
+		t.Fatal("unmarshal", m, err)
+	}
+
+	if _, err := Codec.Marshal("hello"); err != ErrNotProtoMessage {
+		t.Fatal("marshal not proto message", err)
+	}
+	var s string
+	if err := Codec.Unmarshal(b, &s); err != ErrNotProtoMessage {
+		t.Fatal("unmarshal not proto message", err)
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/someonegg/msgpump/v2"
+)
+
+// ErrProtocol is matched by *ProtocolError with errors.Is.
+var ErrProtocol = errors.New("msgpeer: protocol error")
+
+// ProtocolError describes a malformed or unknown frame.
+type ProtocolError struct {
+	Reason string
+	Header []byte // the leading bytes of the frame, empty if Remote
+	Remote bool   // reported by the remote, see ReplyProtocolError
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Remote {
+		return "msgpeer: remote protocol error: " + e.Reason
+	}
+	return fmt.Sprintf("msgpeer: protocol error: %s: %q", e.Reason, e.Header)
+}
+
+// Is returns true if target is ErrProtocol.
+func (e *ProtocolError) Is(target error) bool {
+	return target == ErrProtocol
+}
+
+// ProtocolErrorPolicy defines how the peer handles the malformed or unknown
+// frames, see WithProtocolErrorPolicy.
+type ProtocolErrorPolicy int
+
+const (
+	// DropProtocolError drops the frame, it is the default.
+	DropProtocolError ProtocolErrorPolicy = iota
+	// ReplyProtocolError drops the frame, and replies a protocol error
+	// frame, the remote will report it by the callback.
+	ReplyProtocolError
+	// StopOnProtocolError stops the peer with the *ProtocolError.
+	StopOnProtocolError
+)
+
+// maxErrorHeader is the maximum length of ProtocolError.Header.
+const maxErrorHeader = 32
+
+func (p *Peer) protocolError(m []byte, reason string) {
+	if len(m) > maxErrorHeader {
+		m = m[:maxErrorHeader]
+	}
+	perr := &ProtocolError{
+		Reason: reason,
+		Header: append([]byte(nil), m...),
+	}
+	if p.logger != nil {
+		p.logger.Warn("peer protocol error", "reason", reason, "header", perr.Header)
+	}
+	if p.onProtoErr != nil {
+		p.onProtoErr(perr)
+	}
+
+	switch p.protoPolicy {
+	case ReplyProtocolError:
+		p.Pump.TryOutputPriorityMP(msgpump.PriorityHigh,
+			msgpump.MPMessage{p.idHeader('X', 0), []byte(reason)})
+	case StopOnProtocolError:
+		p.stop(perr)
+	}
+}
+
+// onRemoteProtocolError is called from Peer.Process, it never replies to
+// avoid the loop.
+func (p *Peer) onRemoteProtocolError(body []byte) {
+	if p.logger != nil {
+		p.logger.Warn("peer remote protocol error", "reason", string(body))
+	}
+	if p.onProtoErr != nil {
+		p.onProtoErr(&ProtocolError{Reason: string(body), Remote: true})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/someonegg/gox/syncx"
+	"github.com/someonegg/msgpump/v2"
+)
+
+var ErrStreamClosed = errors.New("msgpeer: stream closed")
+
+// Send writes a chunk of the streaming response, the stream should be ended
+// by calling w(ctx, resp) or w.WriteError.
+//
+// It waits if the flow control window is used up, see InitialStreamWindow.
+// If the caller used Peer.Do, the chunks will be ignored.
+func (w ResponseWriter) Send(ctx context.Context, chunk Response) error {
+	ctx = context.WithValue(ctx, responseKindKey{}, chunkResponse)
+	return w(ctx, chunk)
+}
+
+// ResponseStream receives the streaming response, see Peer.DoStream.
+type ResponseStream struct {
+	p   *Peer
+	rid uint64
+	c   *call
+
+	once  sync.Once
+	stop  func() bool // stops watching the ctx of DoStream
+	cause error       // why the stream is closed, set before c.closeD
+
+	err error
+}
+
+// DoStream will send the request and return a stream to receive the
+// response chunks, which are sent by ResponseWriter.Send.
+//
+// The ctx is used to send the request and carry the deadline, see Peer.Do.
+// If ctx is done before the end, the stream will be closed and the request
+// will be cancelled. The stream should be closed if not received to the end.
+func (p *Peer) DoStream(ctx context.Context, r Request) (*ResponseStream, error) {
+	c := &call{
+		in:     newInbox(p.window),
+		finD:   syncx.NewDoneChan(),
+		closeD: syncx.NewDoneChan(),
+	}
+	rid := p.addCall(c)
+
+	err := p.sendRequest(ctx, 'Q', rid, r)
+	if err != nil {
+		p.removeCall(rid)
+		return nil, err
+	}
+	p.grantCredit(rid, 'q', c.in.initialGrant())
+
+	s := &ResponseStream{p: p, rid: rid, c: c}
+	s.stop = context.AfterFunc(ctx, func() { s.close(ctx.Err()) })
+	return s, nil
+}
+
+// Recv returns the next chunk of the response, the final response will be
+// returned as the last chunk if it is not empty.
+//
+// It returns io.EOF at the end of the stream, or a *RemoteError if the
+// remote handler replied an error response.
+func (s *ResponseStream) Recv(ctx context.Context) (Response, error) {
+	for s.err == nil {
+		if chunk, ok := s.pop(); ok {
+			return chunk, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.c.closeD:
+			s.err = ErrStreamClosed
+			if s.cause != nil {
+				s.err = s.cause
+			}
+		case <-s.p.Pump.StopD():
+			if chunk, ok := s.pop(); ok {
+				return chunk, nil
+			}
+			s.err = msgpump.ErrPumpStopped
+		case <-s.c.in.signal:
+		case <-s.c.finD:
+			if chunk, ok := s.pop(); ok {
+				return chunk, nil
+			}
+			s.stop()
+			s.c.closeD.SetDone()
+			final := s.c.final
+			if final.err != nil {
+				s.err = final.err
+				break
+			}
+			s.err = io.EOF
+			if len(final.resp) > 0 {
+				return final.resp, nil
+			}
+		}
+	}
+	return nil, s.err
+}
+
+func (s *ResponseStream) pop() (Response, bool) {
+	chunk, grant, ok := s.c.in.pop()
+	if grant > 0 && !s.c.finD.R().Done() {
+		s.p.grantCredit(s.rid, 'q', grant)
+	}
+	return chunk, ok
+}
+
+// Close closes the stream, the request will be cancelled if the stream
+// is not ended yet.
+func (s *ResponseStream) Close() error {
+	if s.c.closeD.R().Done() {
+		return nil
+	}
+
+	s.stop()
+	s.close(nil)
+	return nil
+}
+
+func (s *ResponseStream) close(cause error) {
+	s.once.Do(func() {
+		s.cause = cause
+		s.c.closeD.SetDone()
+		s.p.removeCall(s.rid)
+		if !s.c.finD.R().Done() {
+			s.p.cancelRequest(s.rid)
+		}
+	})
+}
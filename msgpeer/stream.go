@@ -0,0 +1,295 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpeer
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/someonegg/gox/syncx"
+	"github.com/someonegg/msgpump/v2"
+)
+
+// StreamAcceptBacklog is the maximum number of remote opened streams waiting
+// to be accepted, the exceeded ones will be refused.
+const StreamAcceptBacklog = 16
+
+// Stream is a bidirectional and ordered message channel, multiplexed with
+// other streams, requests and notifies over the peer.
+//
+// Each direction of the stream is flow controlled, see InitialStreamWindow.
+//
+// Stream supports concurrently access, but the messages sent concurrently
+// are not ordered.
+type Stream struct {
+	p    *Peer
+	id   uint64
+	side byte // 'o' if opened locally, 'a' if accepted
+
+	in     *inbox
+	credit *credit
+
+	locker   sync.Mutex
+	sendErr  error          // not nil after closed
+	recvErr  error          // not nil after the remote closed
+	abortErr error          // not nil after aborted
+	finD     syncx.DoneChan // closed after recvErr is set
+	abortD   syncx.DoneChan // closed after abortErr is set
+}
+
+// streamKey is the key in Peer.streams, the ids of the streams opened by
+// the different sides may be the same.
+type streamKey struct {
+	id   uint64
+	side byte
+}
+
+func newStream(p *Peer, id uint64, side byte) *Stream {
+	return &Stream{
+		p:    p,
+		id:   id,
+		side: side,
+
+		in:     newInbox(p.window),
+		credit: newCredit(),
+
+		finD:   syncx.NewDoneChan(),
+		abortD: syncx.NewDoneChan(),
+	}
+}
+
+// OpenStream opens a new stream, the remote will get it by AcceptStream.
+func (p *Peer) OpenStream(ctx context.Context) (*Stream, error) {
+	p.locker.Lock()
+	p.nsid++
+	s := newStream(p, p.nsid, 'o')
+	p.streams[s.key()] = s
+	p.locker.Unlock()
+
+	err := p.Pump.OutputPriorityMP(ctx, priority(ctx), msgpump.MPMessage{p.idHeader('B', s.id)})
+	if err != nil {
+		p.removeStream(s.key())
+		return nil, err
+	}
+	p.grantCredit(s.id, s.side, s.in.initialGrant())
+	return s, nil
+}
+
+// AcceptStream waits for and returns the next stream opened by the remote.
+func (p *Peer) AcceptStream(ctx context.Context) (*Stream, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-p.Pump.StopD():
+		return nil, msgpump.ErrPumpStopped
+	case s := <-p.acceptC:
+		return s, nil
+	}
+}
+
+// ID returns the stream id, which is unique among the streams opened by
+// the same side.
+func (s *Stream) ID() string {
+	return strconv.FormatUint(s.id, 16)
+}
+
+func (s *Stream) key() streamKey {
+	return streamKey{s.id, s.side}
+}
+
+// Send sends the message with the priority of ctx, see WithPriority.
+//
+// It waits if the flow control window is used up. It returns ErrStreamClosed
+// after closed, or a *RemoteError if the remote closed the stream with error.
+func (s *Stream) Send(ctx context.Context, m []byte) error {
+	s.locker.Lock()
+	err := s.sendErr
+	s.locker.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = s.credit.acquire(ctx, len(m), s.p.Pump.StopD(), s.abortD)
+	if err == ErrStreamClosed {
+		err = s.abortErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.p.Pump.OutputPriorityMP(ctx, priority(ctx), msgpump.MPMessage{s.header('D'), m})
+}
+
+// Recv returns the next message of the stream.
+//
+// It returns io.EOF after the remote closed the stream, or a *RemoteError
+// if the remote closed the stream with error.
+func (s *Stream) Recv(ctx context.Context) ([]byte, error) {
+	for {
+		if s.abortedLocally() {
+			return nil, ErrStreamClosed
+		}
+
+		if m, ok := s.pop(); ok {
+			return m, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-s.abortD:
+		case <-s.finD:
+			if m, ok := s.pop(); ok {
+				return m, nil
+			}
+			return nil, s.recvErr
+		case <-s.p.Pump.StopD():
+			if m, ok := s.pop(); ok {
+				return m, nil
+			}
+			return nil, msgpump.ErrPumpStopped
+		case <-s.in.signal:
+		}
+	}
+}
+
+// abortedLocally returns true if aborted by CloseWithError, the messages
+// received will be dropped.
+func (s *Stream) abortedLocally() bool {
+	// finD is closed too if aborted by the remote.
+	return s.abortD.R().Done() && !s.finD.R().Done()
+}
+
+func (s *Stream) pop() ([]byte, bool) {
+	m, grant, ok := s.in.pop()
+	if grant > 0 && !s.finD.R().Done() {
+		s.p.grantCredit(s.id, s.side, grant)
+	}
+	return m, ok
+}
+
+// Close closes the sending direction of the stream, the remote will get
+// io.EOF after receiving the sent messages.
+func (s *Stream) Close() error {
+	return s.close(nil)
+}
+
+// CloseWithError aborts the stream in both directions, the remote will get
+// a *RemoteError with code and message.
+func (s *Stream) CloseWithError(code int, message string) error {
+	return s.close(&RemoteError{Code: code, Message: message})
+}
+
+func (s *Stream) close(rerr *RemoteError) error {
+	s.locker.Lock()
+	if s.abortErr != nil || (rerr == nil && s.sendErr != nil) {
+		s.locker.Unlock()
+		return nil
+	}
+	s.sendErr = ErrStreamClosed
+	remove := s.recvErr != nil
+	var body []byte
+	if rerr != nil {
+		s.abortErr = ErrStreamClosed
+		s.abortD.SetDone()
+		remove = true
+		body = encodeError(rerr.Code, rerr.Message)
+	}
+	s.locker.Unlock()
+
+	if remove {
+		s.p.removeStream(s.key())
+	}
+
+	// the remote will know the stream is closed when the peer stopped.
+	s.p.Pump.OutputPriorityMP(context.Background(), msgpump.PriorityNormal,
+		msgpump.MPMessage{s.header('F'), body})
+	return nil
+}
+
+// onFin is called from Peer.Process.
+func (s *Stream) onFin(body []byte) {
+	s.locker.Lock()
+	if s.recvErr != nil {
+		s.locker.Unlock()
+		return
+	}
+	s.recvErr = io.EOF
+	if len(body) > 0 {
+		rerr := decodeError(body)
+		s.recvErr = rerr
+		s.sendErr = rerr
+		s.abortErr = rerr
+	}
+	remove := s.sendErr != nil
+	s.finD.SetDone()
+	if s.abortErr != nil {
+		s.abortD.SetDone()
+	}
+	s.locker.Unlock()
+
+	if remove {
+		s.p.removeStream(s.key())
+	}
+}
+
+func (p *Peer) removeStream(key streamKey) {
+	p.locker.Lock()
+	delete(p.streams, key)
+	p.locker.Unlock()
+}
+
+// onStreamFrame handles the stream frames, it returns false if the message
+// exceeds the flow control window, then the stream is aborted.
+func (p *Peer) onStreamFrame(f *frame, body []byte) bool {
+	if f.t == 'B' {
+		s := newStream(p, f.id, 'a')
+		p.locker.Lock()
+		p.streams[s.key()] = s
+		p.locker.Unlock()
+
+		select {
+		case p.acceptC <- s:
+			p.grantCredit(s.id, s.side, s.in.initialGrant())
+		default:
+			s.CloseWithError(CodeStreamRefused, "stream refused")
+		}
+		return true
+	}
+
+	s := p.remoteStream(f.id, f.side)
+	if s == nil {
+		return true
+	}
+
+	switch f.t {
+	case 'D':
+		if !s.in.push(body) {
+			s.CloseWithError(CodeFlowControl, "flow control window exceeded")
+			return false
+		}
+	case 'F':
+		s.onFin(body)
+	}
+	return true
+}
+
+// remoteStream returns the stream of the frame sent by the remote side.
+func (p *Peer) remoteStream(id uint64, side byte) *Stream {
+	// the sender opened the stream if its side is 'o'.
+	key := streamKey{id, 'o'}
+	if side == 'o' {
+		key.side = 'a'
+	}
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	return p.streams[key]
+}
+
+func (s *Stream) header(t byte) []byte {
+	return s.p.header(&frame{t: t, id: s.id, side: s.side})
+}
@@ -0,0 +1,110 @@
+// Copyright 2023 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpump
+
+import (
+	"log/slog"
+	"time"
+)
+
+// DefaultWriteQueueSize is the default size of the write queue.
+const DefaultWriteQueueSize = 64
+
+// Hooks are the optional callbacks for metrics.
+//
+// They are called from the working loop, so they should return as soon
+// as possible.
+type Hooks struct {
+	// OnRead is called after a message is read.
+	OnRead func(size int)
+	// OnWrite is called after a message is written.
+	OnWrite func(size int)
+	// OnFlush is called after a batch is flushed.
+	OnFlush func()
+	// OnStop is called when the working loop is stopped.
+	OnStop func(err error)
+}
+
+type options struct {
+	writeQueueSize int
+	writeBatch     bool
+	readIdle       time.Duration
+	writeTimeout   time.Duration
+	panicLogF      func(interface{})
+	panicLogSet    bool
+	hooks          Hooks
+	logger         *slog.Logger
+}
+
+// Option configures the pump, see NewPumpWithOptions.
+type Option func(*options)
+
+// WithWriteQueueSize sets the size of the write queue for each priority,
+// DefaultWriteQueueSize is used by default.
+func WithWriteQueueSize(size int) Option {
+	return func(o *options) {
+		o.writeQueueSize = size
+	}
+}
+
+// WithWriteBatch sets whether to write the queued messages in batch if the
+// MessageReadWriter implements the Flusher interface, it is enabled by
+// default.
+func WithWriteBatch(enable bool) Option {
+	return func(o *options) {
+		o.writeBatch = enable
+	}
+}
+
+// WithReadIdleTimeout sets the maximum duration to wait for the next message,
+// the pump will stop with ErrReadTimeout if exceeded. Zero means no timeout.
+//
+// It takes effect only if the MessageReadWriter implements the
+// DeadlineSetter interface.
+func WithReadIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.readIdle = d
+	}
+}
+
+// WithWriteTimeout sets the maximum duration of writing a message (or
+// flushing a batch), the pump will stop with ErrWriteTimeout if exceeded.
+// Zero means no timeout.
+//
+// It takes effect only if the MessageReadWriter implements the
+// DeadlineSetter interface.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.writeTimeout = d
+	}
+}
+
+// WithPanicLogFunc sets the panic log function, nil means no log.
+func WithPanicLogFunc(f func(panicV interface{})) Option {
+	return func(o *options) {
+		o.panicLogF = f
+		o.panicLogSet = true
+	}
+}
+
+// WithHooks sets the metrics hooks.
+func WithHooks(hooks Hooks) Option {
+	return func(o *options) {
+		o.hooks = hooks
+	}
+}
+
+// WithLogger sets the structured logger, which records the lifecycle events
+// (start, stop and its reason), the read/write errors, and the panics with
+// stack if the panic log function is not set by WithPanicLogFunc. The worker
+// panics of the parallel handlers are written to it too, see Pump.Start.
+//
+// If the MessageReadWriter has the LocalAddr and RemoteAddr methods (like
+// the one returned by NetconnMRW), the addresses are added as attributes.
+func WithLogger(l *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright 2024 someonegg. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package msgpump
+
+import (
+	"context"
+	"time"
+
+	"github.com/someonegg/msgpump/v2/internal/worker"
+)
+
+// OverloadPolicy defines what to do when all the workers are busy and the
+// maximum is reached, see BoundedParallelHandler.
+type OverloadPolicy int
+
+const (
+	// OverloadBlock waits for an idle worker, which blocks the reading
+	// loop of the pump, so the back-pressure is applied to the remote.
+	OverloadBlock OverloadPolicy = iota
+	// OverloadDrop drops the message.
+	OverloadDrop
+)
+
+type parallHandler struct {
+	h      Handler
+	g      *worker.Group
+	policy OverloadPolicy
+}
+
+// ParallelHandler convert a handler to parallel mode, in which each call
+// will be initiated from a different worker goroutine.
+//
+// The workerPanicLog is optional, the default one writes to the logger of
+// the pump if set, see WithLogger, or to the log package.
+//
+// The number of workers is unbounded, see BoundedParallelHandler.
+func ParallelHandler(h Handler, workerIdleTimeout time.Duration,
+	workerPanicLog func(panicV interface{})) Handler {
+
+	return BoundedParallelHandler(h, workerIdleTimeout, workerPanicLog, 0, OverloadBlock)
+}
+
+// BoundedParallelHandler is like ParallelHandler, but there are maxWorkers
+// workers at most, the policy is applied when all of them are busy. Zero
+// maxWorkers means unbounded.
+func BoundedParallelHandler(h Handler, workerIdleTimeout time.Duration,
+	workerPanicLog func(panicV interface{}), maxWorkers int, policy OverloadPolicy) Handler {
+
+	return &parallHandler{
+		h:      h,
+		g:      worker.NewGroup(workerIdleTimeout, workerPanicLog, maxWorkers),
+		policy: policy,
+	}
+}
+
+func (h *parallHandler) Process(ctx context.Context, m Message) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	f := func() { h.h.Process(ctx, m) }
+	if h.g.TryRun(ctx, f) {
+		return
+	}
+
+	// overloaded
+	if h.policy == OverloadDrop {
+		return
+	}
+	h.g.Run(ctx, f)
+}
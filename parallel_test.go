@@ -0,0 +1,75 @@
+package msgpump
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParallelHandler(test *testing.T) {
+	startC := make(chan struct{}, 3)
+	releaseC := make(chan struct{})
+	doneC := make(chan struct{}, 3)
+	h := func(ctx context.Context, m Message) {
+		startC <- struct{}{}
+		<-releaseC
+		doneC <- struct{}{}
+	}
+
+	ph := BoundedParallelHandler(HandlerFunc(h), time.Second, nil, 2, OverloadBlock)
+	ctx := context.Background()
+	ph.Process(ctx, []byte("m1"))
+	ph.Process(ctx, []byte("m2"))
+	<-startC
+	<-startC
+
+	blockedC := make(chan struct{})
+	go func() {
+		ph.Process(ctx, []byte("m3"))
+		close(blockedC)
+	}()
+	select {
+	case <-startC:
+		test.Fatal("max workers")
+	case <-blockedC:
+		test.Fatal("overload block")
+	default:
+	}
+
+	close(releaseC)
+	<-blockedC
+	<-startC
+	for i := 0; i < 3; i++ {
+		<-doneC
+	}
+}
+
+func TestParallelHandlerDrop(test *testing.T) {
+	startC := make(chan struct{}, 3)
+	releaseC := make(chan struct{})
+	doneC := make(chan struct{}, 3)
+	h := func(ctx context.Context, m Message) {
+		startC <- struct{}{}
+		<-releaseC
+		doneC <- struct{}{}
+	}
+
+	ph := BoundedParallelHandler(HandlerFunc(h), time.Second, nil, 2, OverloadDrop)
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		ph.Process(ctx, []byte("m"))
+	}
+	<-startC
+	<-startC
+
+	close(releaseC)
+	<-doneC
+	<-doneC
+
+	// the third one is dropped at once.
+	select {
+	case <-startC:
+		test.Fatal("drop")
+	default:
+	}
+}
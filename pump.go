@@ -8,16 +8,25 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"net"
+	"os"
 	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/someonegg/gox/syncx"
+	"github.com/someonegg/msgpump/v2/internal/worker"
 )
 
 var (
 	errUnknownPanic = errors.New("unknown panic")
 	ErrPumpStopped  = errors.New("pump stopped")
+	ErrReadTimeout  = errors.New("pump read timeout")
+	ErrWriteTimeout = errors.New("pump write timeout")
 )
 
 type legalPanic struct {
@@ -44,6 +53,18 @@ func (f HandlerFunc) Process(ctx context.Context, m Message) {
 	f(ctx, m)
 }
 
+// Priority is the priority of the output message, the messages with higher
+// priority are always written before the lower ones.
+type Priority int
+
+const (
+	PriorityLow Priority = iota
+	PriorityNormal
+	PriorityHigh
+
+	numPriority = iota
+)
+
 type Statistics struct {
 	// from MessageReadWriter
 	ReadedCount int64
@@ -52,6 +73,8 @@ type Statistics struct {
 	// to MessageReadWriter
 	WrittenCount int64
 	WrittenBytes int64
+	// if MessageReadWriter is a Flusher
+	FlushedCount int64
 
 	// Output call
 	OutputCount int64
@@ -62,46 +85,121 @@ type Statistics struct {
 //
 // Pump supports concurrently access.
 type Pump struct {
-	err   error
-	quitF context.CancelFunc
-	stopD syncx.DoneChan
+	err    error
+	quitF  context.CancelFunc
+	stopD  syncx.DoneChan
+	closeD syncx.DoneChan // set after closed, no output is in flight then
+
+	closed  int32 // 1 after the write queue is closed
+	sending int32 // the outputs in flight
+
+	errL  sync.Mutex
+	serr  error // the error stopped with, see StopWithPanic
+	ended bool  // serr can not be set after ended
 
 	rw MessageReadWriter
 	h  Handler
 	sn StopNotifier
+	fl Flusher
+	ds DeadlineSetter
 
 	// read
-	rerr error
-	rD   syncx.DoneChan
+	rerr  error
+	rD    syncx.DoneChan
+	rIdle time.Duration
 	// write
-	werr error
-	wD   syncx.DoneChan
-	wQ   chan message
+	werr  error
+	wD    syncx.DoneChan
+	wTime time.Duration
+	wQ    [numPriority]chan message
+	wS    []chan error // written but not flushed
 
-	stat Statistics
+	stat   Statistics
+	hooks  Hooks
+	logger *slog.Logger
 
 	panicLogF func(interface{})
 }
 
-// NewPump allocates and returns a new pump.
+// addrs is implemented by the MessageReadWriter over a connection.
+type addrs interface {
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+}
+
+// NewPump allocates and returns a new pump, there is a write queue of
+// writeQueueSize for each priority.
+//
+// Note that the auto flush of rw is disabled while the pump is running if
+// rw implements the Flusher interface, see NewPumpWithOptions.
+//
+// It is a shortcut of NewPumpWithOptions.
+func NewPump(rw MessageReadWriter, h Handler, writeQueueSize int) *Pump {
+	return NewPumpWithOptions(rw, h, WithWriteQueueSize(writeQueueSize))
+}
+
+// NewPumpWithOptions allocates and returns a new pump configured by opts.
 //
 // If rw implementes the StopNotifier interface, it will be called when
 // the working loop exiting.
-func NewPump(rw MessageReadWriter, h Handler, writeQueueSize int) *Pump {
+//
+// If rw implementes the Flusher interface, the queued messages will be
+// written in batch and flushed once per batch, see WithWriteBatch. For that
+// the auto flush of rw is disabled by calling SetAutoFlush(false) in Start,
+// and is enabled again after the pump is stopped. Use WithWriteBatch(false)
+// to leave rw untouched.
+//
+// If rw implementes the DeadlineSetter interface, the read idle timeout and
+// the write timeout can be used, see WithReadIdleTimeout and WithWriteTimeout.
+func NewPumpWithOptions(rw MessageReadWriter, h Handler, opts ...Option) *Pump {
+	o := options{
+		writeQueueSize: DefaultWriteQueueSize,
+		writeBatch:     true,
+		panicLogF:      thePanicLogFunc,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	sn, _ := rw.(StopNotifier)
-	return &Pump{
-		stopD: syncx.NewDoneChan(),
+	ds, _ := rw.(DeadlineSetter)
+	fl, _ := rw.(Flusher)
+	if !o.writeBatch {
+		fl = nil
+	}
+	logger := o.logger
+	if logger != nil {
+		if a, ok := rw.(addrs); ok {
+			logger = logger.With("local", a.LocalAddr().String(), "remote", a.RemoteAddr().String())
+		}
+		if !o.panicLogSet {
+			o.panicLogF = LogPanicFunc(logger, "pump panic")
+		}
+	}
+	p := &Pump{
+		stopD:  syncx.NewDoneChan(),
+		closeD: syncx.NewDoneChan(),
 
 		rw: rw,
 		h:  h,
 		sn: sn,
+		fl: fl,
+		ds: ds,
+
+		rD:    syncx.NewDoneChan(),
+		rIdle: o.readIdle,
+		wD:    syncx.NewDoneChan(),
+		wTime: o.writeTimeout,
 
-		rD: syncx.NewDoneChan(),
-		wD: syncx.NewDoneChan(),
-		wQ: make(chan message, writeQueueSize),
+		hooks:  o.hooks,
+		logger: logger,
 
-		panicLogF: thePanicLogFunc,
+		panicLogF: o.panicLogF,
+	}
+	for i := range p.wQ {
+		p.wQ[i] = make(chan message, o.writeQueueSize)
 	}
+	return p
 }
 
 // The default panic log function.
@@ -112,16 +210,40 @@ func thePanicLogFunc(v interface{}) {
 	log.Print("pump panic: ", v, fmt.Sprintf("\n%s", buf))
 }
 
-// SetPanicLogFunc is optional.
+// LogPanicFunc returns a panic log function which writes the panic with
+// stack to l as an error record with msg, it can be used by WithPanicLogFunc
+// or the parallel handlers.
+func LogPanicFunc(l *slog.Logger, msg string) func(panicV interface{}) {
+	return worker.LogPanicFunc(l, msg)
+}
+
+// Logger returns the structured logger with the connection attributes, nil
+// if not set, see WithLogger.
+func (p *Pump) Logger() *slog.Logger {
+	return p.logger
+}
+
+// SetPanicLogFunc is optional, see WithPanicLogFunc too.
 func (p *Pump) SetPanicLogFunc(f func(panicV interface{})) {
 	p.panicLogF = f
 }
 
 // Start will start the working loop.
+//
+// If the logger is set, see WithLogger, the ctx passed to the handler
+// carries it, so the worker panics of the parallel handlers are written to
+// it by default.
 func (p *Pump) Start(parent context.Context) {
 	if parent == nil {
 		parent = context.Background()
 	}
+	if p.logger != nil {
+		parent = worker.WithLogger(parent, p.logger)
+	}
+
+	if p.fl != nil {
+		p.fl.SetAutoFlush(false)
+	}
 
 	var ctx context.Context
 	ctx, p.quitF = context.WithCancel(parent)
@@ -129,6 +251,10 @@ func (p *Pump) Start(parent context.Context) {
 	go p.reading(ctx)
 	go p.writing(ctx)
 	go p.monitor(ctx)
+
+	if p.logger != nil {
+		p.logger.Info("pump started")
+	}
 }
 
 func (p *Pump) monitor(ctx context.Context) {
@@ -142,6 +268,10 @@ func (p *Pump) monitor(ctx context.Context) {
 }
 
 func (p *Pump) ending() {
+	p.errL.Lock()
+	p.ended = true
+	p.errL.Unlock()
+
 	if e := recover(); e != nil {
 		legal := false
 		switch v := e.(type) {
@@ -170,6 +300,17 @@ func (p *Pump) ending() {
 
 	<-p.rD
 	<-p.wD
+
+	if p.fl != nil {
+		p.fl.SetAutoFlush(true)
+	}
+
+	if p.hooks.OnStop != nil {
+		p.hooks.OnStop(p.Error())
+	}
+	if p.logger != nil {
+		p.logger.Info("pump stopped", "error", p.Error())
+	}
 }
 
 func (p *Pump) reading(ctx context.Context) {
@@ -179,7 +320,11 @@ func (p *Pump) reading(ctx context.Context) {
 			switch v := e.(type) {
 			case legalPanic:
 				legal = true
-				p.err = v.err
+				// ignore the error caused by stopping.
+				if ctx.Err() == nil {
+					p.err = v.err
+					p.logIOError("pump read error", v.err)
+				}
 			case error:
 				p.rerr = v
 			default:
@@ -207,12 +352,22 @@ func (p *Pump) reading(ctx context.Context) {
 }
 
 func (p *Pump) readMessage() Message {
+	if p.rIdle > 0 && p.ds != nil {
+		p.ds.SetReadDeadline(time.Now().Add(p.rIdle))
+	}
+
 	m, err := p.rw.ReadMessage()
 	if err != nil {
+		if isTimeout(err) {
+			err = ErrReadTimeout
+		}
 		panic(legalPanic{err})
 	}
 	atomic.AddInt64(&p.stat.ReadedCount, 1)
 	atomic.AddInt64(&p.stat.ReadedBytes, int64(m.Size()))
+	if p.hooks.OnRead != nil {
+		p.hooks.OnRead(m.Size())
+	}
 	return m
 }
 
@@ -224,6 +379,9 @@ func (p *Pump) writing(ctx context.Context) {
 			case legalPanic:
 				legal = true
 				p.err = v.err
+				if ctx.Err() == nil {
+					p.logIOError("pump write error", v.err)
+				}
 			case error:
 				p.werr = v
 			default:
@@ -241,24 +399,156 @@ func (p *Pump) writing(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			q = true
-		case m := <-p.wQ:
-			p.writeMessage(m)
+		case <-p.closeD:
+			p.writeRemaining(ctx)
+			q = true
+		case m := <-p.wQ[PriorityHigh]:
+			p.writeQueued(PriorityHigh, m)
+		case m := <-p.wQ[PriorityNormal]:
+			p.writeQueued(PriorityNormal, m)
+		case m := <-p.wQ[PriorityLow]:
+			p.writeQueued(PriorityLow, m)
+		}
+	}
+}
+
+// writeQueued writes m of pri after the queued messages with higher priority.
+func (p *Pump) writeQueued(pri Priority, m message) {
+	for i := PriorityHigh; i > pri; i-- {
+		for n := len(p.wQ[i]); n > 0; n-- {
+			p.writeMessage(<-p.wQ[i])
+		}
+	}
+
+	p.writeMessage(m)
+
+	if p.fl != nil {
+		p.writeBatch()
+	}
+}
+
+// writeRemaining writes all the remaining messages after the write queue
+// is closed.
+func (p *Pump) writeRemaining(ctx context.Context) {
+	for ctx.Err() == nil {
+		m, ok := p.nextQueued()
+		if !ok {
+			break
+		}
+		p.writeMessage(m)
+	}
+
+	if p.fl != nil {
+		p.flush()
+	}
+}
+
+// writeBatch writes the messages already queued, then flushes them together.
+func (p *Pump) writeBatch() {
+	n := 0
+	for i := range p.wQ {
+		n += len(p.wQ[i])
+	}
+
+	for ; n > 0; n-- {
+		m, _ := p.nextQueued()
+		p.writeMessage(m)
+	}
+
+	p.flush()
+}
+
+// nextQueued returns the queued message with the highest priority.
+func (p *Pump) nextQueued() (message, bool) {
+	for i := PriorityHigh; i >= PriorityLow; i-- {
+		select {
+		case m := <-p.wQ[i]:
+			return m, true
+		default:
 		}
 	}
+	return message{}, false
+}
+
+func (p *Pump) flush() {
+	p.setWriteDeadline()
+
+	err := p.fl.Flush()
+	if err != nil && isTimeout(err) {
+		err = ErrWriteTimeout
+	}
+	p.synced(err)
+	if err != nil {
+		panic(legalPanic{err})
+	}
+	atomic.AddInt64(&p.stat.FlushedCount, 1)
+	if p.hooks.OnFlush != nil {
+		p.hooks.OnFlush()
+	}
 }
 
 func (p *Pump) writeMessage(m message) {
+	p.setWriteDeadline()
+
 	var err error
 	if m.mS != nil {
 		err = p.rw.WriteMessage(m.mS)
 	} else {
 		err = p.rw.WriteMessageMP(m.mM)
 	}
+	if err != nil && isTimeout(err) {
+		err = ErrWriteTimeout
+	}
+	if m.done != nil {
+		p.wS = append(p.wS, m.done)
+	}
 	if err != nil {
+		p.synced(err)
 		panic(legalPanic{err})
 	}
 	atomic.AddInt64(&p.stat.WrittenCount, 1)
 	atomic.AddInt64(&p.stat.WrittenBytes, int64(m.Size()))
+	if p.hooks.OnWrite != nil {
+		p.hooks.OnWrite(m.Size())
+	}
+	if p.fl == nil {
+		p.synced(nil)
+	}
+}
+
+func (p *Pump) setWriteDeadline() {
+	if p.wTime > 0 && p.ds != nil {
+		p.ds.SetWriteDeadline(time.Now().Add(p.wTime))
+	}
+}
+
+// logIOError logs the read/write error, io.EOF is logged at info level.
+func (p *Pump) logIOError(msg string, err error) {
+	if p.logger == nil {
+		return
+	}
+	level := slog.LevelWarn
+	if err == io.EOF {
+		level = slog.LevelInfo
+	}
+	p.logger.Log(context.Background(), level, msg, "error", err)
+}
+
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// synced notifies the synchronous outputs that their messages are written.
+func (p *Pump) synced(err error) {
+	for i, done := range p.wS {
+		done <- err
+		p.wS[i] = nil
+	}
+	p.wS = p.wS[:0]
 }
 
 // Stop requests to stop the pump, the working loop will stop asynchronously.
@@ -266,6 +556,81 @@ func (p *Pump) Stop() {
 	p.quitF()
 }
 
+// StopWithPanic stops the pump as if v is panicked from Handler.Process,
+// it is used by the handlers processing the messages in other goroutines.
+// The v is logged by the panic log function, and Error will return v if it
+// is an error.
+func (p *Pump) StopWithPanic(v interface{}) {
+	if p.panicLogF != nil {
+		p.panicLogF(v)
+	}
+	err, ok := v.(error)
+	if !ok {
+		err = errUnknownPanic
+	}
+	p.stopWith(err)
+}
+
+// StopWithError requests to stop the pump like Stop, and Error will return
+// err. The err is ignored if the pump is already stopping.
+func (p *Pump) StopWithError(err error) {
+	p.stopWith(err)
+}
+
+// stopWith stops the pump with err, it is ignored if the pump is stopping.
+func (p *Pump) stopWith(err error) {
+	p.errL.Lock()
+	if !p.ended && p.serr == nil {
+		p.serr = err
+	}
+	p.errL.Unlock()
+	p.quitF()
+}
+
+// StopGraceful requests to stop the pump gracefully. The write queue will
+// be closed at once, then the working loop will stop after all the queued
+// messages are written.
+//
+// It waits until the pump is stopped and returns the pump's error, or
+// stops the pump immediately and returns ctx.Err() if ctx is done first.
+func (p *Pump) StopGraceful(ctx context.Context) error {
+	p.closeQueue()
+
+	select {
+	case <-p.stopD:
+		return p.Error()
+	case <-ctx.Done():
+		p.quitF()
+		return ctx.Err()
+	}
+}
+
+// closeQueue closes the write queue, closeD will be set after the outputs
+// in flight are done, so the writer can drain the queue completely then.
+func (p *Pump) closeQueue() {
+	atomic.StoreInt32(&p.closed, 1)
+	if atomic.LoadInt32(&p.sending) == 0 {
+		p.closeD.SetDone()
+	}
+}
+
+// enterOutput returns false if the write queue is closed, or the caller
+// should call leaveOutput after done.
+func (p *Pump) enterOutput() bool {
+	atomic.AddInt32(&p.sending, 1)
+	if atomic.LoadInt32(&p.closed) == 1 || p.stopD.R().Done() {
+		p.leaveOutput()
+		return false
+	}
+	return true
+}
+
+func (p *Pump) leaveOutput() {
+	if atomic.AddInt32(&p.sending, -1) == 0 && atomic.LoadInt32(&p.closed) == 1 {
+		p.closeD.SetDone()
+	}
+}
+
 // StopD returns a done channel, it will be signaled when the pump is stopped.
 func (p *Pump) StopD() syncx.DoneChanR {
 	return p.stopD.R()
@@ -277,6 +642,9 @@ func (p *Pump) Stopped() bool {
 
 // Error can only be called after pump stopped.
 func (p *Pump) Error() error {
+	if p.serr != nil {
+		return p.serr
+	}
 	if p.err != nil {
 		return p.err
 	}
@@ -286,47 +654,109 @@ func (p *Pump) Error() error {
 	return p.werr
 }
 
-// Output puts the message to the write queue.
-func (p *Pump) Output(ctx context.Context, m Message) (err error) {
+// Output puts the message to the write queue with normal priority.
+func (p *Pump) Output(ctx context.Context, m Message) error {
+	return p.output(ctx, PriorityNormal, message{mS: m})
+}
+
+// TryOutput tries to put the message to the write queue with normal priority.
+func (p *Pump) TryOutput(m Message) bool {
+	return p.tryOutput(PriorityNormal, message{mS: m})
+}
+
+// OutputMP puts the multipart message to the write queue with normal priority.
+func (p *Pump) OutputMP(ctx context.Context, m MPMessage) error {
+	return p.output(ctx, PriorityNormal, message{mM: m})
+}
+
+// TryOutputMP tries to put the multipart message to the write queue with
+// normal priority.
+func (p *Pump) TryOutputMP(m MPMessage) bool {
+	return p.tryOutput(PriorityNormal, message{mM: m})
+}
+
+// OutputPriority puts the message to the write queue with pri.
+func (p *Pump) OutputPriority(ctx context.Context, pri Priority, m Message) error {
+	return p.output(ctx, pri, message{mS: m})
+}
+
+// TryOutputPriority tries to put the message to the write queue with pri.
+func (p *Pump) TryOutputPriority(pri Priority, m Message) bool {
+	return p.tryOutput(pri, message{mS: m})
+}
+
+// OutputPriorityMP puts the multipart message to the write queue with pri.
+func (p *Pump) OutputPriorityMP(ctx context.Context, pri Priority, m MPMessage) error {
+	return p.output(ctx, pri, message{mM: m})
+}
+
+// TryOutputPriorityMP tries to put the multipart message to the write queue
+// with pri.
+func (p *Pump) TryOutputPriorityMP(pri Priority, m MPMessage) bool {
+	return p.tryOutput(pri, message{mM: m})
+}
+
+// OutputSync puts the message to the write queue with normal priority, and
+// waits until it is written to the MessageReadWriter (and flushed if it is
+// a Flusher).
+//
+// If ctx is done first, ctx.Err() is returned, but the message may still
+// be written later.
+func (p *Pump) OutputSync(ctx context.Context, m Message) error {
+	return p.outputSync(ctx, message{mS: m, done: make(chan error, 1)})
+}
+
+// OutputSyncMP is the multipart version of OutputSync.
+func (p *Pump) OutputSyncMP(ctx context.Context, m MPMessage) error {
+	return p.outputSync(ctx, message{mM: m, done: make(chan error, 1)})
+}
+
+func (p *Pump) outputSync(ctx context.Context, m message) error {
+	err := p.output(ctx, PriorityNormal, m)
+	if err != nil {
+		return err
+	}
+
 	select {
+	case err = <-m.done:
+		return err
 	case <-ctx.Done():
-		err = ctx.Err()
+		return ctx.Err()
 	case <-p.stopD:
-		err = ErrPumpStopped
-	case p.wQ <- message{mS: m}:
-		atomic.AddInt64(&p.stat.OutputCount, 1)
+		select {
+		case err = <-m.done:
+			return err
+		default:
+			return ErrPumpStopped
+		}
 	}
-	return
 }
 
-// TryOutput tries to put the message to the write queue.
-func (p *Pump) TryOutput(m Message) bool {
-	select {
-	case p.wQ <- message{mS: m}:
-		atomic.AddInt64(&p.stat.OutputCount, 1)
-		return true
-	default:
-		return false
+func (p *Pump) output(ctx context.Context, pri Priority, m message) (err error) {
+	if !p.enterOutput() {
+		return ErrPumpStopped
 	}
-}
+	defer p.leaveOutput()
 
-// OutputMP puts the multipart message to the write queue.
-func (p *Pump) OutputMP(ctx context.Context, m MPMessage) (err error) {
 	select {
 	case <-ctx.Done():
 		err = ctx.Err()
 	case <-p.stopD:
 		err = ErrPumpStopped
-	case p.wQ <- message{mM: m}:
+	case p.queue(pri) <- m:
 		atomic.AddInt64(&p.stat.OutputCount, 1)
 	}
 	return
 }
 
-// TryOutputMP tries to put the multipart message to the write queue.
-func (p *Pump) TryOutputMP(m MPMessage) bool {
+func (p *Pump) tryOutput(pri Priority, m message) bool {
+	if !p.enterOutput() {
+		return false
+	}
+	defer p.leaveOutput()
+
 	select {
-	case p.wQ <- message{mM: m}:
+	case p.queue(pri) <- m:
 		atomic.AddInt64(&p.stat.OutputCount, 1)
 		return true
 	default:
@@ -334,12 +764,23 @@ func (p *Pump) TryOutputMP(m MPMessage) bool {
 	}
 }
 
+func (p *Pump) queue(pri Priority) chan message {
+	if pri < PriorityLow {
+		pri = PriorityLow
+	}
+	if pri > PriorityHigh {
+		pri = PriorityHigh
+	}
+	return p.wQ[pri]
+}
+
 func (p *Pump) Statistics() Statistics {
 	return Statistics{
 		ReadedCount:  atomic.LoadInt64(&p.stat.ReadedCount),
 		ReadedBytes:  atomic.LoadInt64(&p.stat.ReadedBytes),
 		WrittenCount: atomic.LoadInt64(&p.stat.WrittenCount),
 		WrittenBytes: atomic.LoadInt64(&p.stat.WrittenBytes),
+		FlushedCount: atomic.LoadInt64(&p.stat.FlushedCount),
 		OutputCount:  atomic.LoadInt64(&p.stat.OutputCount),
 	}
 }
@@ -2,7 +2,13 @@ package msgpump
 
 import (
 	"context"
+	"errors"
 	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -158,3 +164,333 @@ func TestPumpWriteAndStop(test *testing.T) {
 		test.Fatal("pump error", err)
 	}
 }
+
+func TestPumpWriteBatch(test *testing.T) {
+	rw := &mockFlushMRW{mockMRW: mockMRW{rsus: make(chan bool)}, auto: true}
+
+	h := func(ctx context.Context, m Message) {}
+
+	pump := NewPump(rw, HandlerFunc(h), 10)
+	if !rw.auto {
+		test.Fatal("auto flush before start")
+	}
+
+	for i := 0; i < 10; i++ {
+		pump.Output(context.Background(), []byte("m"))
+	}
+	pump.Start(nil)
+	if rw.auto {
+		test.Fatal("auto flush")
+	}
+
+	for i := 0; i < 100; i++ {
+		if pump.Statistics().WrittenCount == 10 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	pump.Stop()
+	<-pump.StopD()
+
+	stat := pump.Statistics()
+	if stat.WrittenCount != 10 || stat.FlushedCount != 1 || rw.fcnt != 1 {
+		test.Fatal("write batch", stat)
+	}
+	if !rw.auto {
+		test.Fatal("auto flush not restored")
+	}
+}
+
+func TestPumpStopGraceful(test *testing.T) {
+	rw := &mockMRW{rsus: make(chan bool)}
+
+	h := func(ctx context.Context, m Message) {}
+
+	pump := NewPump(rw, HandlerFunc(h), 3)
+	pump.Start(nil)
+
+	pump.Output(context.Background(), []byte("m1"))
+	pump.Output(context.Background(), []byte("m2"))
+	pump.OutputMP(context.Background(), MPMessage{[]byte("m3")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	if err := pump.StopGraceful(ctx); err != nil {
+		test.Fatal("stop graceful", err)
+	}
+
+	if rw.wcnt != 3 {
+		test.Fatal("write count", rw.wcnt)
+	}
+
+	if err := pump.Output(context.Background(), []byte("m4")); err != ErrPumpStopped {
+		test.Fatal("output after stop", err)
+	}
+}
+
+func TestPumpStopGracefulTimeout(test *testing.T) {
+	rw := &mockMRW{rsus: make(chan bool), wsus: make(chan bool)}
+
+	h := func(ctx context.Context, m Message) {}
+
+	pump := NewPump(rw, HandlerFunc(h), 1)
+	pump.Start(nil)
+
+	pump.Output(context.Background(), []byte("m1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := pump.StopGraceful(ctx); err != context.DeadlineExceeded {
+		test.Fatal("stop graceful", err)
+	}
+
+	select {
+	case <-pump.StopD():
+	case <-time.After(1 * time.Second):
+		test.Fatal("pump stop")
+	}
+}
+
+func TestPumpOutputSync(test *testing.T) {
+	rw := &mockFlushMRW{mockMRW: mockMRW{rsus: make(chan bool), wmax: 2}}
+
+	h := func(ctx context.Context, m Message) {}
+
+	pump := NewPump(rw, HandlerFunc(h), 1)
+	pump.Start(nil)
+
+	err := pump.OutputSync(context.Background(), []byte("m1"))
+	if err != nil || rw.wcnt != 1 || rw.fcnt != 1 {
+		test.Fatal("output sync", err)
+	}
+
+	err = pump.OutputSyncMP(context.Background(), MPMessage{[]byte("m2")})
+	if err != nil || rw.wcnt != 2 || rw.fcnt != 2 {
+		test.Fatal("output sync", err)
+	}
+
+	err = pump.OutputSync(context.Background(), []byte("m3"))
+	if err != io.ErrClosedPipe {
+		test.Fatal("output sync error", err)
+	}
+
+	<-pump.StopD()
+	err = pump.OutputSync(context.Background(), []byte("m4"))
+	if err != ErrPumpStopped {
+		test.Fatal("output sync after stop", err)
+	}
+}
+
+func TestPumpWritePriority(test *testing.T) {
+	rw := &mockMRW{rsus: make(chan bool)}
+
+	h := func(ctx context.Context, m Message) {}
+
+	pump := NewPump(rw, HandlerFunc(h), 2)
+
+	pump.OutputPriority(context.Background(), PriorityLow, []byte("l"))
+	pump.Output(context.Background(), []byte("n"))
+	pump.TryOutputPriorityMP(PriorityHigh, MPMessage{[]byte("h")})
+	pump.OutputPriority(context.Background(), PriorityLow, []byte("l"))
+	pump.TryOutputPriority(PriorityHigh, []byte("h"))
+
+	pump.Start(nil)
+	pump.StopGraceful(context.Background())
+
+	if s := string(rw.b.Bytes()); s != "1:h1:h1:n1:l1:l" {
+		test.Fatal("write priority", s)
+	}
+}
+
+func TestPumpWithOptions(test *testing.T) {
+	rw := &mockFlushMRW{mockMRW: mockMRW{rmax: 2}, auto: true}
+
+	h := func(ctx context.Context, m Message) {}
+
+	reads := 0
+	stopC := make(chan error, 1)
+	pump := NewPumpWithOptions(rw, HandlerFunc(h),
+		WithWriteQueueSize(2),
+		WithWriteBatch(false),
+		WithPanicLogFunc(nil),
+		WithHooks(Hooks{
+			OnRead: func(size int) { reads++ },
+			OnStop: func(err error) { stopC <- err },
+		}),
+	)
+	if !rw.auto {
+		test.Fatal("auto flush")
+	}
+
+	pump.Output(context.Background(), []byte("m1"))
+	pump.Output(context.Background(), []byte("m2"))
+	if pump.TryOutput([]byte("m3")) {
+		test.Fatal("write queue size")
+	}
+	pump.Start(nil)
+
+	select {
+	case err := <-stopC:
+		if err != io.EOF {
+			test.Fatal("stop hook", err)
+		}
+	case <-time.After(1 * time.Second):
+		test.Fatal("pump stop")
+	}
+
+	if reads != 2 || rw.fcnt != 0 {
+		test.Fatal("hooks", reads, rw.fcnt)
+	}
+}
+
+func TestPumpReadIdleTimeout(test *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	h := func(ctx context.Context, m Message) {}
+
+	pump := NewPumpWithOptions(NetconnMRW(c1), HandlerFunc(h),
+		WithReadIdleTimeout(10*time.Millisecond))
+	pump.Start(nil)
+
+	select {
+	case <-pump.StopD():
+	case <-time.After(1 * time.Second):
+		test.Fatal("read idle timeout")
+	}
+
+	if err := pump.Error(); err != ErrReadTimeout {
+		test.Fatal("read idle timeout error", err)
+	}
+}
+
+func TestPumpWriteTimeout(test *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	h := func(ctx context.Context, m Message) {}
+
+	pump := NewPumpWithOptions(NetconnMRW(c1), HandlerFunc(h),
+		WithWriteTimeout(10*time.Millisecond))
+	pump.Start(nil)
+
+	err := pump.OutputSync(context.Background(), []byte("m1"))
+	if err != ErrWriteTimeout {
+		test.Fatal("write timeout", err)
+	}
+
+	<-pump.StopD()
+	if err := pump.Error(); err != ErrWriteTimeout {
+		test.Fatal("write timeout error", err)
+	}
+}
+
+func TestPumpStopWithError(test *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+
+	h := func(ctx context.Context, m Message) {}
+
+	errStop := errors.New("stop")
+	pump := NewPump(NetconnMRW(c1), HandlerFunc(h), 1)
+	pump.Start(nil)
+	pump.StopWithError(errStop)
+	<-pump.StopD()
+
+	// ignored after stopped.
+	pump.StopWithError(io.ErrUnexpectedEOF)
+	if err := pump.Error(); err != errStop {
+		test.Fatal("stop with error", err)
+	}
+}
+
+func TestPumpLogger(test *testing.T) {
+	var b syncBuffer
+	logger := slog.New(slog.NewTextHandler(&b, nil))
+
+	c1, c2 := net.Pipe()
+	h := func(ctx context.Context, m Message) {
+		panic("boom")
+	}
+	pump := NewPumpWithOptions(NetconnMRW(c1), HandlerFunc(h), WithLogger(logger))
+	pump.Start(nil)
+
+	NetconnMRW(c2).WriteMessage([]byte("m1"))
+
+	select {
+	case <-pump.StopD():
+	case <-time.After(1 * time.Second):
+		test.Fatal("panic stop")
+	}
+
+	s := b.String()
+	for _, want := range []string{
+		`msg="pump started" local=pipe remote=pipe`,
+		`msg="pump panic"`, "panic=boom", "stack=",
+		`msg="pump stopped"`,
+	} {
+		if !strings.Contains(s, want) {
+			test.Fatal("log", want, s)
+		}
+	}
+}
+
+func TestPumpStopGracefulRace(test *testing.T) {
+	for i := 0; i < 50; i++ {
+		rw := &mockMRW{rsus: make(chan bool)}
+
+		h := func(ctx context.Context, m Message) {}
+
+		pump := NewPump(rw, HandlerFunc(h), 1)
+		pump.Start(nil)
+
+		var outputs int64
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for pump.Output(context.Background(), []byte("m")) == nil {
+					atomic.AddInt64(&outputs, 1)
+				}
+			}()
+		}
+
+		if err := pump.StopGraceful(context.Background()); err != nil {
+			test.Fatal("stop graceful", err)
+		}
+		wg.Wait()
+
+		if int64(rw.wcnt) != outputs {
+			test.Fatal("lost output", rw.wcnt, outputs)
+		}
+	}
+}
+
+func TestPumpTryOutputWhileClosing(test *testing.T) {
+	rw := &mockMRW{rsus: make(chan bool), wsus: make(chan bool)}
+
+	h := func(ctx context.Context, m Message) {}
+
+	pump := NewPump(rw, HandlerFunc(h), 1)
+	pump.Start(nil)
+
+	// the writer is suspended, m3 is in flight.
+	pump.Output(context.Background(), []byte("m1"))
+	pump.Output(context.Background(), []byte("m2"))
+	go pump.Output(context.Background(), []byte("m3"))
+	go pump.StopGraceful(context.Background())
+
+	tryC := make(chan bool, 1)
+	go func() {
+		tryC <- pump.TryOutput([]byte("m4"))
+	}()
+	select {
+	case <-tryC:
+	case <-time.After(1 * time.Second):
+		test.Fatal("try output blocked")
+	}
+
+	pump.Stop()
+	<-pump.StopD()
+}